@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// authRealm is sent in WWW-Authenticate challenges
+	authRealm = "Camera Tunnel"
+	// authCacheTTL is how long a successful credentials check is reused
+	authCacheTTL = time.Minute
+	// authCacheMax bounds the remembered checks; the cache is emptied when full
+	authCacheMax = 1024
+)
+
+// dummyHash is compared against when the username is wrong, so a bad
+// username takes as long to reject as a bad password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("camera-tunnel"), bcrypt.DefaultCost)
+
+// authUserKey carries the authenticated username in request contexts
+type authUserKey struct{}
+
+// authEnabled reports whether HTTP Basic Auth is configured
+func (c *Config) authEnabled() bool {
+	return c.AuthUsername != "" || c.AuthPasswordHash != "" || len(c.AuthUsers) > 0
+}
+
+// authUsers returns the bcrypt hash of every user, the admin included
+func (c *Config) authUsers() map[string]string {
+	users := make(map[string]string, len(c.AuthUsers)+1)
+	for user, hash := range c.AuthUsers {
+		users[user] = hash
+	}
+	if c.AuthUsername != "" {
+		users[c.AuthUsername] = c.AuthPasswordHash
+	}
+	return users
+}
+
+// validateAuth checks the Basic Auth settings at startup
+func (c *Config) validateAuth() error {
+	if !c.authEnabled() {
+		return nil
+	}
+	if (c.AuthUsername == "") != (c.AuthPasswordHash == "") {
+		return fmt.Errorf("auth_username and auth_password_hash must be set together")
+	}
+	if c.AuthPasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(c.AuthPasswordHash)); err != nil {
+			return fmt.Errorf("auth_password_hash is not a valid bcrypt hash: %v", err)
+		}
+	}
+	for user, hash := range c.AuthUsers {
+		if user == "" || strings.Contains(user, ":") {
+			return fmt.Errorf("auth_users: invalid username %q", user)
+		}
+		if user == c.AuthUsername {
+			return fmt.Errorf("auth_users: %q is already auth_username", user)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("auth_users: hash for %q is not a valid bcrypt hash: %v", user, err)
+		}
+	}
+	for _, path := range c.PublicPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("public path %q must start with /", path)
+		}
+	}
+	return nil
+}
+
+// isPublicPath reports whether path is exempt from authentication. Entries
+// ending in "/" match everything under them, others must match exactly.
+func (c *Config) isPublicPath(path string) bool {
+	for _, public := range c.PublicPaths {
+		if path == public || (strings.HasSuffix(public, "/") && strings.HasPrefix(path, public)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCredentials compares user and password with the configured users
+func (c *Config) checkCredentials(user, password string) bool {
+	userOK := false
+	hash := dummyHash
+	for name, userHash := range c.authUsers() {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(name)) == 1 {
+			userOK = true
+			hash = []byte(userHash)
+		}
+	}
+	passwordOK := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+
+	return userOK && passwordOK
+}
+
+// authCache remembers recent successful credentials checks, so a viewer
+// fetching an HLS segment every two seconds or a monitor polling the API
+// doesn't cost a bcrypt comparison per request. Entries are keyed by an
+// HMAC of the user's hash and user:password under a per-process key, so
+// passwords aren't kept in memory and a changed hash invalidates them.
+type authCache struct {
+	key []byte
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]time.Time // HMAC -> expiry
+}
+
+func newAuthCache() *authCache {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &authCache{key: key, entries: make(map[[sha256.Size]byte]time.Time)}
+}
+
+// sum returns the cache key for user's credentials checked against hash
+func (a *authCache) sum(hash, user, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, a.key)
+	// bcrypt hashes have a fixed length and users can't contain ':', so
+	// the fields can't run into each other
+	mac.Write([]byte(hash))
+	mac.Write([]byte(user + ":" + password))
+	var sum [sha256.Size]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// valid reports whether sum was checked successfully within the TTL
+func (a *authCache) valid(sum [sha256.Size]byte, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	expiry, ok := a.entries[sum]
+	if ok && now.After(expiry) {
+		delete(a.entries, sum)
+		return false
+	}
+	return ok
+}
+
+// add remembers a successful check of sum
+func (a *authCache) add(sum [sha256.Size]byte, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) >= authCacheMax {
+		for key, expiry := range a.entries {
+			if now.After(expiry) {
+				delete(a.entries, key)
+			}
+		}
+		if len(a.entries) >= authCacheMax {
+			a.entries = make(map[[sha256.Size]byte]time.Time)
+		}
+	}
+	a.entries[sum] = now.Add(authCacheTTL)
+}
+
+// checkCredentials is Config.checkCredentials with recent successes
+// reused from the auth cache. Misses, wrong passwords included, always take
+// the constant-time bcrypt path.
+func (s *Server) checkCredentials(user, password string) bool {
+	now := time.Now()
+	sum := s.authCache.sum(s.config.authUsers()[user], user, password)
+	if s.authCache.valid(sum, now) {
+		return true
+	}
+	if !s.config.checkCredentials(user, password) {
+		return false
+	}
+	s.authCache.add(sum, now)
+	return true
+}
+
+// authenticatedUser returns the user whose credentials r carries, or "".
+// Requests to PublicPaths skip the middleware, so their credentials are
+// checked here.
+func (s *Server) authenticatedUser(r *http.Request) string {
+	if user, ok := r.Context().Value(authUserKey{}).(string); ok {
+		return user
+	}
+	if !s.config.authEnabled() {
+		return ""
+	}
+	if user, password, ok := r.BasicAuth(); ok && s.checkCredentials(user, password) {
+		return user
+	}
+	return ""
+}
+
+// cameraAllowed reports whether the user behind r may view camera
+func (s *Server) cameraAllowed(r *http.Request, camera Camera) bool {
+	if len(camera.AllowedUsers) == 0 {
+		return true
+	}
+	user := s.authenticatedUser(r)
+	if user == "" {
+		return false
+	}
+	for _, allowed := range camera.AllowedUsers {
+		if user == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// withBasicAuth requires HTTP Basic Auth on every route except PublicPaths
+func (s *Server) withBasicAuth(next http.Handler) http.Handler {
+	if !s.config.authEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok || !s.checkCredentials(user, password) {
+			if ok {
+				s.logger.Printf("Rejected credentials for user %q from %s", user, s.clientIP(r))
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)))
+	})
+}
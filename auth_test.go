@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestCheckCredentialsCache checks that a successful check is reused only
+// for the same password and hash, and only until it expires
+func TestCheckCredentialsCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(&Config{AuthUsername: "admin", AuthPasswordHash: string(hash)})
+	s.logger.SetOutput(&syncBuffer{})
+
+	if s.checkCredentials("admin", "wrong") {
+		t.Fatal("wrong password accepted")
+	}
+	if len(s.authCache.entries) != 0 {
+		t.Fatal("a failed check was cached")
+	}
+	if !s.checkCredentials("admin", "secret") {
+		t.Fatal("right password rejected")
+	}
+	if len(s.authCache.entries) != 1 {
+		t.Fatalf("%d cached checks after a success, want 1", len(s.authCache.entries))
+	}
+	if !s.checkCredentials("admin", "secret") {
+		t.Error("cached check rejected")
+	}
+	if s.checkCredentials("admin", "wrong") || s.checkCredentials("other", "secret") {
+		t.Error("cached check accepted other credentials")
+	}
+
+	sum := s.authCache.sum(string(hash), "admin", "secret")
+	if s.authCache.valid(sum, time.Now().Add(authCacheTTL+time.Second)) {
+		t.Error("cached check still valid after its TTL")
+	}
+
+	// A new hash for the same password invalidates the old entries
+	s.checkCredentials("admin", "secret")
+	rotated, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.AuthPasswordHash = string(rotated)
+	if s.checkCredentials("admin", "secret") {
+		t.Error("old password accepted from the cache after the hash changed")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultStreamGracePeriod = 10 * time.Second
+	// subscriberQueue is how many fragments may wait for a viewer's copy loop
+	subscriberQueue = 64
+	// maxMP4Box guards against a corrupt size field allocating unbounded memory
+	maxMP4Box = 64 * 1024 * 1024
+	// streamStartTimeout is how long a viewer waits for the first data
+	// before getting an error instead of a video
+	streamStartTimeout = 10 * time.Second
+	// streamPreflightTimeout is how long /stream/ waits for the camera to
+	// accept a TCP connection before starting FFmpeg
+	streamPreflightTimeout = 2 * time.Second
+)
+
+// errNoVideo reports that a stream produced nothing within streamStartTimeout
+var errNoVideo = errors.New("no video within the start timeout")
+
+// streamGracePeriod returns how long a shared transcode outlives its last viewer
+func (c *Config) streamGracePeriod() time.Duration {
+	if c.StreamGracePeriod > 0 {
+		return time.Duration(c.StreamGracePeriod)
+	}
+	return defaultStreamGracePeriod
+}
+
+// streamStallTimeout returns how long a shared stream may go without output
+// before FFmpeg is stopped. It is twice the socket timeout, so it only
+// catches FFmpeg processes that hang with the camera connection still alive.
+func (c *Config) streamStallTimeout() time.Duration {
+	return 2 * c.rtspTimeout()
+}
+
+// streamSubscriber is one viewer of a shared stream. It reads like the
+// FFmpeg pipe it replaces, so the usual copy loop and slow-client handling
+// apply unchanged.
+type streamSubscriber struct {
+	ch      chan []byte
+	pending []byte
+	// dropped is set before ch is closed when the viewer fell behind
+	dropped bool
+	// owner is the transcode feeding ch. A restart moves viewers to the
+	// new one, so it changes, but only with the old owner's mu held.
+	owner atomic.Pointer[streamBroadcaster]
+}
+
+func (sub *streamSubscriber) Read(p []byte) (int, error) {
+	if len(sub.pending) == 0 {
+		data, ok := <-sub.ch
+		if !ok {
+			if sub.dropped {
+				return 0, errSlowClient
+			}
+			return 0, io.EOF
+		}
+		sub.pending = data
+	}
+	n := copy(p, sub.pending)
+	sub.pending = sub.pending[n:]
+	return n, nil
+}
+
+// waitForData blocks until the stream has data for this viewer. It returns
+// io.EOF if the stream ended first, errNoVideo after timeout, or the
+// context's error.
+func (sub *streamSubscriber) waitForData(ctx context.Context, timeout time.Duration) error {
+	if len(sub.pending) > 0 {
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case data, ok := <-sub.ch:
+		if !ok {
+			return io.EOF
+		}
+		sub.pending = data
+		return nil
+	case <-timer.C:
+		return errNoVideo
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// streamBroadcaster runs one FFmpeg transcode for a camera at one quality
+// level and fans its fragmented MP4 output out to every subscriber. New
+// subscribers get the init segment (ftyp+moov) first and then join at the
+// next fragment, which always starts on a keyframe.
+type streamBroadcaster struct {
+	cameraID string
+	quality  string
+	cmd      *exec.Cmd
+	diag     *stderrDiagnoser
+	lastData atomic.Int64 // UnixNano of the last box read from FFmpeg
+
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+	init        []byte
+	idleTimer   *time.Timer
+	stopped     bool
+}
+
+// streamKey identifies a shared transcode
+type streamKey struct {
+	cameraID string
+	quality  string
+}
+
+// streamManager holds the running broadcaster per camera and quality level
+type streamManager struct {
+	mu          sync.Mutex
+	broadcaster map[streamKey]*streamBroadcaster
+}
+
+// runningBroadcaster returns the transcode viewers of key can join. Callers
+// hold s.streams.mu.
+func (s *Server) runningBroadcaster(key streamKey) (*streamBroadcaster, bool) {
+	// A broadcaster stopped for being idle may not have exited yet
+	b, ok := s.streams.broadcaster[key]
+	if !ok || b.isStopped() {
+		return nil, false
+	}
+	return b, true
+}
+
+// subscribeStream attaches a viewer to cameraID's transcode at quality,
+// starting it if none is running
+func (s *Server) subscribeStream(cameraID, quality string, camera Camera) (*streamBroadcaster, *streamSubscriber, error) {
+	key := streamKey{cameraID: cameraID, quality: quality}
+	sub := &streamSubscriber{ch: make(chan []byte, subscriberQueue)}
+
+	// The transcode found may stop before the viewer is attached, in which
+	// case the next one is started
+	for attempt := 1; ; attempt++ {
+		b, err := s.joinableBroadcaster(key, camera)
+		if err != nil {
+			return nil, nil, err
+		}
+		if viewers, ok := b.add(sub); ok {
+			s.logger.Printf("%s now has %d viewer(s) on its shared %s stream", camera.Name, viewers, quality)
+			return b, sub, nil
+		}
+		if attempt == 3 {
+			return nil, nil, fmt.Errorf("shared stream for %s ended before it could be joined", camera.Name)
+		}
+	}
+}
+
+// joinableBroadcaster returns the transcode for key, starting it if none is
+// running. Picking the RTSP URL may probe unreachable failover URLs, so the
+// args are built without holding s.streams.mu, which every viewer of every
+// camera needs.
+func (s *Server) joinableBroadcaster(key streamKey, camera Camera) (*streamBroadcaster, error) {
+	s.streams.mu.Lock()
+	b, ok := s.runningBroadcaster(key)
+	s.streams.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	args := s.streamArgs(key.cameraID, key.quality, camera)
+
+	s.streams.mu.Lock()
+	defer s.streams.mu.Unlock()
+	// Another viewer may have started it in the meantime
+	if b, ok := s.runningBroadcaster(key); ok {
+		return b, nil
+	}
+	b, err := s.startBroadcaster(key.cameraID, key.quality, camera, args)
+	if err != nil {
+		return nil, err
+	}
+	if s.streams.broadcaster == nil {
+		s.streams.broadcaster = make(map[streamKey]*streamBroadcaster)
+	}
+	s.streams.broadcaster[key] = b
+	return b, nil
+}
+
+// add attaches sub, returning the number of viewers, or false if the
+// transcode has already stopped
+func (b *streamBroadcaster) add(sub *streamSubscriber) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return 0, false
+	}
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+		b.idleTimer = nil
+	}
+	if b.init != nil {
+		sub.ch <- b.init
+	}
+	b.subscribers[sub] = struct{}{}
+	sub.owner.Store(b)
+	return len(b.subscribers), true
+}
+
+// streamRunning reports whether cameraID has a shared transcode at any
+// quality that viewers can join
+func (s *Server) streamRunning(cameraID string) bool {
+	s.streams.mu.Lock()
+	defer s.streams.mu.Unlock()
+	for key, b := range s.streams.broadcaster {
+		if key.cameraID == cameraID && !b.isStopped() {
+			return true
+		}
+	}
+	return false
+}
+
+// lockOwner returns the transcode sub is attached to with its mu held, or
+// nil if sub was never attached
+func (sub *streamSubscriber) lockOwner() *streamBroadcaster {
+	for {
+		b := sub.owner.Load()
+		if b == nil {
+			return nil
+		}
+		b.mu.Lock()
+		// A restart may have moved sub while we waited for the lock
+		if sub.owner.Load() == b {
+			return b
+		}
+		b.mu.Unlock()
+	}
+}
+
+// unsubscribe detaches a viewer, stopping FFmpeg after the grace period if it was the last
+func (s *Server) unsubscribe(sub *streamSubscriber) {
+	b := sub.lockOwner()
+	if b == nil {
+		return
+	}
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[sub]; !ok {
+		return
+	}
+	delete(b.subscribers, sub)
+	close(sub.ch)
+
+	if len(b.subscribers) == 0 && !b.stopped {
+		b.idleTimer = time.AfterFunc(s.config.streamGracePeriod(), func() {
+			b.mu.Lock()
+			idle := len(b.subscribers) == 0
+			if idle {
+				b.stopped = true
+			}
+			b.mu.Unlock()
+			if idle {
+				s.logger.Printf("No viewers left for %s, stopping shared %s stream", b.cameraID, b.quality)
+				stopFFmpeg(b.cmd)
+			}
+		})
+	}
+}
+
+func (b *streamBroadcaster) isStopped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stopped
+}
+
+// startBroadcaster starts FFmpeg with args, built by streamArgs for the
+// camera at quality, and the goroutine that distributes its output
+func (s *Server) startBroadcaster(cameraID, quality string, camera Camera, args []string) (*streamBroadcaster, error) {
+	s.log.Debug("Starting FFmpeg", "event", "ffmpeg_command", "camera_id", cameraID, "quality", quality, "command", s.ffmpegCommandLine(redactArgs(args)))
+	cmd := s.ffmpegCommand(s.ctx, args...)
+	diag := &stderrDiagnoser{log: s.log, cameraID: cameraID}
+	cmd.Stderr = io.MultiWriter(&streamInfoWriter{store: &s.streamInfo, cameraID: cameraID}, diag)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create FFmpeg pipe: %v", err)
+	}
+	if err := s.startFFmpeg(cmd); err != nil {
+		s.metrics.ffmpegFailed(cameraID, "stream")
+		return nil, fmt.Errorf("failed to start FFmpeg: %v", err)
+	}
+	s.metrics.ffmpegStarted(cameraID, "stream")
+	s.logger.Printf("Started shared %s stream for %s (%s)", quality, camera.Name, cameraID)
+
+	b := &streamBroadcaster{
+		cameraID:    cameraID,
+		quality:     quality,
+		cmd:         cmd,
+		diag:        diag,
+		subscribers: make(map[*streamSubscriber]struct{}),
+	}
+
+	unregister := s.work.add(fmt.Sprintf("%s shared %s stream", cameraID, quality), closerFunc(func() error {
+		return cmd.Process.Kill()
+	}))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer unregister()
+
+		done := make(chan struct{})
+		b.lastData.Store(time.Now().UnixNano())
+		go s.watchStream(b, s.config.streamStallTimeout(), done)
+		err := b.pump(stdout)
+		close(done)
+		idleStop := b.isStopped()
+		stopFFmpeg(cmd)
+		waitErr := cmd.Wait()
+		if err != nil && s.ctx.Err() == nil {
+			s.logger.Printf("Shared stream for %s ended: %v", camera.Name, err)
+		}
+		if (err != nil || waitErr != nil) && s.ctx.Err() == nil && !idleStop {
+			s.metrics.ffmpegFailed(cameraID, "stream")
+		}
+
+		s.streams.mu.Lock()
+		key := streamKey{cameraID: cameraID, quality: quality}
+		if s.streams.broadcaster[key] == b {
+			delete(s.streams.broadcaster, key)
+		}
+		s.streams.mu.Unlock()
+		b.stop()
+	}()
+
+	return b, nil
+}
+
+// watchStream stops b's FFmpeg if it produces no output for timeout, which
+// ends the stream for its viewers, until done is closed
+func (s *Server) watchStream(b *streamBroadcaster, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			idle := now.Sub(time.Unix(0, b.lastData.Load()))
+			if idle < timeout || b.isStopped() {
+				continue
+			}
+			s.log.Warn("Stream stalled, stopping FFmpeg", "event", "stream_stalled", "camera_id", b.cameraID, "idle", idle.Round(time.Second).String())
+			stopFFmpeg(b.cmd)
+			return
+		}
+	}
+}
+
+// pump reads top-level MP4 boxes from FFmpeg and broadcasts each complete
+// fragment, until the pipe closes
+func (b *streamBroadcaster) pump(r io.Reader) error {
+	var initSegment, fragment []byte
+	for {
+		box, boxType, err := readMP4Box(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		b.lastData.Store(time.Now().UnixNano())
+
+		switch {
+		case b.init == nil && boxType != "moof":
+			initSegment = append(initSegment, box...)
+			if boxType == "moov" {
+				b.setInit(initSegment)
+			}
+		case boxType == "moof":
+			fragment = append([]byte(nil), box...)
+		default:
+			fragment = append(fragment, box...)
+			if boxType == "mdat" {
+				b.broadcast(fragment)
+				fragment = nil
+			}
+		}
+	}
+}
+
+// setInit records the init segment and sends it to viewers that were
+// already waiting for it
+func (b *streamBroadcaster) setInit(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.init = data
+	for sub := range b.subscribers {
+		sub.ch <- data
+	}
+}
+
+// broadcast queues data for every subscriber. A subscriber whose queue is
+// full has stopped reading, so it is detached rather than allowed to stall
+// the stream for everyone else, and its reads end with errSlowClient.
+func (b *streamBroadcaster) broadcast(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- data:
+		default:
+			delete(b.subscribers, sub)
+			sub.dropped = true
+			close(sub.ch)
+		}
+	}
+}
+
+// stop ends every subscriber's stream once FFmpeg has exited
+func (b *streamBroadcaster) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stopped = true
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+	}
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// readMP4Box reads one complete top-level box, returning its raw bytes and type
+func readMP4Box(r io.Reader) ([]byte, string, error) {
+	header := make([]byte, 8, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", err
+	}
+
+	size := uint64(binary.BigEndian.Uint32(header[:4]))
+	boxType := string(header[4:8])
+	if size == 1 {
+		header = header[:16]
+		if _, err := io.ReadFull(r, header[8:]); err != nil {
+			return nil, "", err
+		}
+		size = binary.BigEndian.Uint64(header[8:16])
+	}
+	if size < uint64(len(header)) || size > maxMP4Box {
+		return nil, "", fmt.Errorf("invalid %q box size %d", boxType, size)
+	}
+
+	box := make([]byte, size)
+	copy(box, header)
+	if _, err := io.ReadFull(r, box[len(header):]); err != nil {
+		return nil, "", err
+	}
+	return box, boxType, nil
+}
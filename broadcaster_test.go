@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestStreamClientDisconnect closes a viewer's connection mid-stream and
+// checks it is unsubscribed, that the shared FFmpeg outlives it for the grace
+// period and is then stopped with SIGTERM rather than killed
+func TestStreamClientDisconnect(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	ffmpeg, _ := fakeFFmpeg(t)
+	s := newTestAPIServer(t, &Config{
+		FFmpegPath:        ffmpeg,
+		SkipPreflight:     true,
+		StreamGracePeriod: Duration(grace),
+		Cameras: map[string]Camera{
+			"front": {Name: "Front", RTSPURL: "rtsp://127.0.0.1:1/front"},
+		},
+	})
+
+	resp, err := s.request(http.MethodGet, "/stream/front", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream returned %d", resp.StatusCode)
+	}
+	for i := 0; i < 6; i++ {
+		if _, _, err := readMP4Box(resp.Body); err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+	}
+
+	s.streams.mu.Lock()
+	b := s.streams.broadcaster[streamKey{cameraID: "front", quality: defaultQuality}]
+	s.streams.mu.Unlock()
+	if b == nil {
+		t.Fatal("no shared stream is running")
+	}
+	// idle reports whether the viewer is gone and the grace period started
+	idle := func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.subscribers) == 0 && b.idleTimer != nil
+	}
+	if idle() {
+		t.Fatal("the stream is idle with its viewer still connected")
+	}
+
+	// Closing the body mid-stream drops the connection
+	closed := time.Now()
+	resp.Body.Close()
+	waitFor(t, idle)
+	if b.isStopped() {
+		t.Error("the shared stream stopped before its grace period ended")
+	}
+	if _, running := s.ffmpegProcs.running()[b.cmd.Process]; !running {
+		t.Error("FFmpeg exited before the grace period ended")
+	}
+
+	waitFor(t, func() bool {
+		_, running := s.ffmpegProcs.running()[b.cmd.Process]
+		return !running
+	})
+	if elapsed := time.Since(closed); elapsed < grace {
+		t.Errorf("FFmpeg stopped %v after the viewer left, want at least %v", elapsed, grace)
+	}
+	if _, err := os.Stat(ffmpeg + ".terminated"); err != nil {
+		t.Errorf("FFmpeg wasn't sent SIGTERM: %v", err)
+	}
+	if !b.isStopped() {
+		t.Error("the shared stream isn't marked stopped")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// cameraIDPattern keeps IDs usable as a single URL path segment and temp file name
+var cameraIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// camera returns the camera with the given ID. Handlers must use this rather
+// than s.config.Cameras directly, since cameras can be added and removed at runtime.
+func (s *Server) camera(id string) (Camera, bool) {
+	s.camerasMu.RLock()
+	defer s.camerasMu.RUnlock()
+
+	camera, exists := s.config.Cameras[id]
+	return camera, exists
+}
+
+// cameraList returns a copy of the configured cameras that is safe to range over
+func (s *Server) cameraList() map[string]Camera {
+	s.camerasMu.RLock()
+	defer s.camerasMu.RUnlock()
+
+	cameras := make(map[string]Camera, len(s.config.Cameras))
+	for id, camera := range s.config.Cameras {
+		cameras[id] = camera
+	}
+	return cameras
+}
+
+// validateNewCamera checks a camera submitted through the API with the same
+// checks as the config file, plus the ID and name the API needs
+func validateNewCamera(id string, camera Camera, authUsers map[string]string) error {
+	if !cameraIDPattern.MatchString(id) {
+		return fmt.Errorf("id must be letters, digits, '-' or '_'")
+	}
+	if camera.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	problems := validateCamera(id, camera, authUsers)
+	if len(problems) == 0 {
+		return nil
+	}
+	messages := make([]string, len(problems))
+	for i, err := range problems {
+		messages[i] = err.Error()
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+// requireAdmin rejects camera changes and other admin requests unless Basic
+// Auth is configured and the request carries auth_username's credentials,
+// even when the path is in PublicPaths
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.AuthUsername == "" {
+		writeJSONError(w, "This request requires auth_username and auth_password_hash to be configured", http.StatusForbidden)
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || !s.checkCredentials(user, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if user != s.config.AuthUsername {
+		writeJSONError(w, "Only auth_username may make this request", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleCameras serves the camera collection: GET lists, POST adds
+func (s *Server) handleCameras(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleCameraList(w, r)
+	case http.MethodPost:
+		s.handleAddCamera(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCamera serves a single camera: GET shows details, DELETE removes it,
+// and the /ffmpeg and /restart suffixes are routed to their handlers
+func (s *Server) handleCamera(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/ffmpeg") {
+		s.handleCameraFFmpeg(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/restart") {
+		s.handleCameraRestart(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleCameraDetail(w, r)
+	case http.MethodDelete:
+		s.handleDeleteCamera(w, r)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleAddCamera(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+		Camera
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, fmt.Sprintf("Invalid camera JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateNewCamera(req.ID, req.Camera, s.config.authUsers()); err != nil {
+		writeJSONError(w, fmt.Sprintf("Invalid camera: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.camerasMu.Lock()
+	if _, exists := s.config.Cameras[req.ID]; exists {
+		s.camerasMu.Unlock()
+		writeJSONError(w, fmt.Sprintf("Camera '%s' already exists", req.ID), http.StatusConflict)
+		return
+	}
+
+	cameras := make(map[string]Camera, len(s.config.Cameras)+1)
+	for id, camera := range s.config.Cameras {
+		cameras[id] = camera
+	}
+	cameras[req.ID] = req.Camera
+
+	slugs, err := buildSlugIndex(cameras)
+	if err != nil {
+		s.camerasMu.Unlock()
+		writeJSONError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err := s.commitCameras(cameras); err != nil {
+		s.camerasMu.Unlock()
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.slugs = slugs
+	s.camerasMu.Unlock()
+
+	// Publish, record and sprites start with the camera, outside the lock
+	// since stopping an old task waits for its FFmpeg to exit; the config
+	// is already saved, so a failure is only logged
+	if err := s.startCameraTasks(req.ID, req.Camera); err != nil {
+		s.logger.Printf("Camera %s: failed to start publish, sprites or record: %v", req.ID, err)
+	}
+
+	s.logger.Printf("Added camera %s (%s) via API", req.Camera.Name, req.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/cameras/"+req.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         req.ID,
+		"name":       req.Camera.Name,
+		"stream_url": fmt.Sprintf("/stream/%s", req.ID),
+		"viewer_url": viewerPath(req.ID, req.Camera),
+	})
+}
+
+func (s *Server) handleDeleteCamera(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	cameraID := strings.TrimPrefix(r.URL.Path, "/api/cameras/")
+
+	s.camerasMu.Lock()
+	camera, exists := s.config.Cameras[cameraID]
+	if !exists {
+		s.camerasMu.Unlock()
+		writeJSONError(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+
+	cameras := make(map[string]Camera, len(s.config.Cameras))
+	for id, c := range s.config.Cameras {
+		if id != cameraID {
+			cameras[id] = c
+		}
+	}
+	// Removing a camera can't introduce a slug conflict
+	slugs, _ := buildSlugIndex(cameras)
+	err := s.commitCameras(cameras)
+	if err == nil {
+		s.slugs = slugs
+	}
+	s.camerasMu.Unlock()
+
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.stopCameraStreams(cameraID)
+	s.logger.Printf("Removed camera %s (%s) via API", camera.Name, cameraID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commitCameras persists cameras to the config file and then swaps them in,
+// leaving the running set untouched if the write fails. Callers hold camerasMu.
+func (s *Server) commitCameras(cameras map[string]Camera) error {
+	if s.configPath != "" {
+		// Start from the file rather than s.config so command-line
+		// overrides aren't written into it; if it can't be read, nothing is
+		onDisk, err := loadConfig(s.configPath)
+		if err != nil {
+			return fmt.Errorf("failed to read config %s: %v", s.configPath, err)
+		}
+		updated := *onDisk
+		updated.Cameras = cameras
+		if err := saveConfig(&updated, s.configPath); err != nil {
+			return fmt.Errorf("failed to save config: %v", err)
+		}
+	}
+	s.config.Cameras = cameras
+	return nil
+}
+
+// stopCameraStreams ends every FFmpeg of a removed camera: its publisher,
+// recorder and sprite task and its viewer transcodes
+func (s *Server) stopCameraStreams(cameraID string) {
+	if s.stopCameraTasks(cameraID) {
+		s.logger.Printf("Camera %s: stopped publish, sprites and record", cameraID)
+	}
+	s.stopViewerStreams(cameraID)
+}
+
+// stopViewerStreams ends the camera's shared stream, multiplexed MJPEG, HLS
+// and WebRTC transcodes
+func (s *Server) stopViewerStreams(cameraID string) {
+	s.streams.mu.Lock()
+	for key, b := range s.streams.broadcaster {
+		if key.cameraID == cameraID {
+			stopFFmpeg(b.cmd)
+		}
+	}
+	s.streams.mu.Unlock()
+
+	// Its sockets are told the stream ended now, rather than once FFmpeg
+	// has exited, so they get no more frames from the old RTSP URL
+	s.frames.mu.Lock()
+	source, ok := s.frames.sources[cameraID]
+	if ok {
+		delete(s.frames.sources, cameraID)
+	}
+	s.frames.mu.Unlock()
+	if ok {
+		source.stop()
+		stopFFmpeg(source.cmd)
+	}
+
+	s.stopViewerTranscodes(cameraID)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestCameraChangesDuringRequests adds, deletes and reloads cameras while
+// viewers open their streams and pages, checking every response is either
+// complete or a clean 404 and that no FFmpeg outlives its camera. Run it
+// with -race to check the handlers only see consistent camera snapshots.
+func TestCameraChangesDuringRequests(t *testing.T) {
+	const duration = 1500 * time.Millisecond
+	ffmpeg, _ := fakeFFmpeg(t)
+	config := &Config{
+		VPSHost:           "vps.example.com",
+		VPSPort:           22,
+		VPSUser:           "tunnel",
+		SSHPassword:       "hunter2",
+		LocalHTTPPort:     8080,
+		VPSHTTPPort:       8081,
+		FFmpegPath:        ffmpeg,
+		SkipPreflight:     true,
+		StreamGracePeriod: Duration(50 * time.Millisecond),
+		Cameras: map[string]Camera{
+			"front": {Name: "Front", RTSPURL: "rtsp://127.0.0.1:1/front"},
+		},
+	}
+	s := newTestAPIServer(t, config)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("test config is invalid: %v", err)
+	}
+	// Saved with the admin credentials, which Reload reads back
+	s.configPath = filepath.Join(t.TempDir(), "camera_config.json")
+	if err := saveConfig(config, s.configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, body string) (int, string) {
+		resp, err := s.request(method, path, body)
+		if err != nil {
+			t.Errorf("%s %s: %v", method, path, err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		if strings.HasPrefix(path, "/stream/") && resp.StatusCode == http.StatusOK {
+			// Watch a few fragments, then leave
+			for i := 0; i < 4; i++ {
+				if _, _, err := readMP4Box(resp.Body); err != nil {
+					break
+				}
+			}
+			return resp.StatusCode, ""
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	// expect reports a status outside want
+	expect := func(method, path string, status int, want ...int) {
+		for _, code := range want {
+			if status == code {
+				return
+			}
+		}
+		t.Errorf("%s %s returned %d, want one of %v", method, path, status, want)
+	}
+
+	var watched, added atomic.Int64
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	run := func(n int, loop func()) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					loop()
+				}
+			}()
+		}
+	}
+
+	run(3, func() {
+		for _, cameraID := range []string{"front", "temp"} {
+			status, _ := do(http.MethodGet, "/stream/"+cameraID, "")
+			// A deleted camera's stream may end before any video
+			expect(http.MethodGet, "/stream/"+cameraID, status, http.StatusOK, http.StatusNotFound, http.StatusBadGateway)
+			if status == http.StatusOK {
+				watched.Add(1)
+			}
+		}
+	})
+	run(2, func() {
+		for cameraID, name := range map[string]string{"front": "Front", "temp": "Temp"} {
+			status, body := do(http.MethodGet, "/camera/"+cameraID, "")
+			expect(http.MethodGet, "/camera/"+cameraID, status, http.StatusOK, http.StatusNotFound)
+			if status == http.StatusOK && (!strings.Contains(body, name) || !strings.Contains(body, "</html>")) {
+				t.Errorf("/camera/%s rendered without its camera or cut short:\n%s", cameraID, body)
+			}
+			status, _ = do(http.MethodGet, "/api/cameras/"+cameraID, "")
+			expect(http.MethodGet, "/api/cameras/"+cameraID, status, http.StatusOK, http.StatusNotFound)
+		}
+		status, _ := do(http.MethodGet, "/api/cameras", "")
+		expect(http.MethodGet, "/api/cameras", status, http.StatusOK)
+	})
+	run(1, func() {
+		status, _ := do(http.MethodPost, "/api/cameras", `{"id": "temp", "name": "Temp", "rtsp_url": "rtsp://127.0.0.1:1/temp"}`)
+		expect(http.MethodPost, "/api/cameras", status, http.StatusCreated, http.StatusConflict)
+		if status == http.StatusCreated {
+			added.Add(1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		status, _ = do(http.MethodDelete, "/api/cameras/temp", "")
+		expect(http.MethodDelete, "/api/cameras/temp", status, http.StatusNoContent, http.StatusNotFound)
+	})
+	run(1, func() {
+		if err := s.Reload(); err != nil {
+			t.Errorf("Reload: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	})
+	wg.Wait()
+
+	// Whatever was left of temp ends with its last viewer
+	do(http.MethodDelete, "/api/cameras/temp", "")
+	waitFor(t, func() bool { return len(s.ffmpegProcs.running()) == 0 })
+	if _, exists := s.camera("temp"); exists {
+		t.Error("temp is still configured after its final delete")
+	}
+	if _, exists := s.camera("front"); !exists {
+		t.Error("front is missing after the reloads")
+	}
+	if watched.Load() == 0 || added.Load() == 0 {
+		t.Errorf("%d streams watched and %d cameras added, want some of each", watched.Load(), added.Load())
+	}
+}
+
+// TestCameraDeleteEndsMultiStream deletes a camera a /ws/multi socket is
+// subscribed to and checks the socket is told its stream ended and the
+// camera's MJPEG FFmpeg stops, while the socket's other camera carries on
+func TestCameraDeleteEndsMultiStream(t *testing.T) {
+	// Stand-in for FFmpeg writing mpjpeg parts until it is stopped
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nwhile true; do printf -- '--" + mjpegBoundary + "\\r\\nContent-Type: image/jpeg\\r\\nContent-Length: 4\\r\\n\\r\\nJPEG\\r\\n' || exit 0; sleep 0.05; done\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestAPIServer(t, &Config{
+		FFmpegPath:    ffmpeg,
+		SkipPreflight: true,
+		Cameras: map[string]Camera{
+			"front": {Name: "Front", RTSPURL: "rtsp://127.0.0.1:1/front"},
+			"back":  {Name: "Back", RTSPURL: "rtsp://127.0.0.1:1/back"},
+		},
+	})
+
+	wsConfig, err := websocket.NewConfig("ws"+strings.TrimPrefix(s.URL, "http")+"/ws/multi", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsConfig.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := websocket.JSON.Send(ws, multiRequest{Action: "subscribe", Cameras: []string{"front", "back"}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// receive reads messages until until returns true for a reply or, for
+	// a frame, its camera
+	receive := func(until func(reply *multiReply, frameCamera string) bool) {
+		t.Helper()
+		for {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if data[0] == '{' {
+				var reply multiReply
+				if err := json.Unmarshal(data, &reply); err != nil {
+					t.Fatalf("invalid reply %q: %v", data, err)
+				}
+				if until(&reply, "") {
+					return
+				}
+			} else if until(nil, string(data[1:1+int(data[0])])) {
+				return
+			}
+		}
+	}
+	subscribed := 0
+	receive(func(reply *multiReply, _ string) bool {
+		if reply != nil && reply.Type == "subscribed" {
+			subscribed++
+		}
+		return subscribed == 2
+	})
+	s.frames.mu.Lock()
+	front := s.frames.sources["front"]
+	s.frames.mu.Unlock()
+
+	resp, err := s.request(http.MethodDelete, "/api/cameras/front", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d", resp.StatusCode)
+	}
+
+	receive(func(reply *multiReply, _ string) bool {
+		return reply != nil && reply.Type == "ended" && reply.Camera == "front"
+	})
+	waitFor(t, func() bool {
+		_, running := s.ffmpegProcs.running()[front.cmd.Process]
+		return !running
+	})
+	// Frames queued before the notice may still follow it, but once the
+	// queue has drained only the remaining camera's frames arrive
+	for frames := 0; frames < multiFrameQueue+5; frames++ {
+		receive(func(reply *multiReply, frameCamera string) bool {
+			if frameCamera == "front" && frames >= multiFrameQueue {
+				t.Fatal("the deleted camera still sends frames")
+			}
+			return frameCamera != ""
+		})
+	}
+}
+
+// TestAddCameraValidation checks that the camera API refuses a camera the
+// config file's validation would, so it is never saved to stop the next
+// startup
+func TestAddCameraValidation(t *testing.T) {
+	config := validTestConfig()
+	s := newTestAPIServer(t, config)
+	s.configPath = filepath.Join(t.TempDir(), "camera_config.json")
+	if err := saveConfig(config, s.configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range map[string]string{
+		"bad recording schedule": `{"id": "back", "name": "Back", "rtsp_url": "rtsp://127.0.0.1:554/back", "record": {"enabled": true, "start": "08:00"}}`,
+		"unknown allowed user":   `{"id": "back", "name": "Back", "rtsp_url": "rtsp://127.0.0.1:554/back", "allowed_users": ["mallory"]}`,
+		"missing RTSP URL":       `{"id": "back", "name": "Back"}`,
+	} {
+		resp, err := s.request(http.MethodPost, "/api/cameras", body)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: POST returned %d, want 400", name, resp.StatusCode)
+		}
+	}
+
+	saved, err := loadConfig(s.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := saved.Cameras["back"]; exists {
+		t.Error("an invalid camera was saved to the config file")
+	}
+	if err := saved.Validate(); err != nil {
+		t.Errorf("saved config no longer validates: %v", err)
+	}
+}
+
+// TestAddCameraUnreadableConfig checks that a camera isn't added when the
+// config file can't be read, rather than overwriting it with the running
+// config and its command-line overrides
+func TestAddCameraUnreadableConfig(t *testing.T) {
+	s := newTestAPIServer(t, validTestConfig())
+	s.configPath = filepath.Join(t.TempDir(), "camera_config.json")
+	const corrupt = `{"vps_host": "vps.example.com",`
+	if err := os.WriteFile(s.configPath, []byte(corrupt), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.request(http.MethodPost, "/api/cameras", `{"id": "back", "name": "Back", "rtsp_url": "rtsp://127.0.0.1:554/back"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("POST returned %d, want 500", resp.StatusCode)
+	}
+	if data, _ := os.ReadFile(s.configPath); string(data) != corrupt {
+		t.Errorf("config file was rewritten:\n%s", data)
+	}
+	if _, exists := s.camera("back"); exists {
+		t.Error("camera was added although the config couldn't be saved")
+	}
+}
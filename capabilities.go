@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxStderrLine bounds how much of a single FFmpeg stderr line is buffered
+const maxStderrLine = 4096
+
+var (
+	videoStreamPattern = regexp.MustCompile(`Stream #\d+:\d+.*?: Video: ([A-Za-z0-9_]+)`)
+	resolutionPattern  = regexp.MustCompile(`, (\d{2,5})x(\d{2,5})`)
+	fpsPattern         = regexp.MustCompile(`, ([\d.]+) fps`)
+)
+
+// StreamInfo is what FFmpeg reported about a camera's video the last time a stream started
+type StreamInfo struct {
+	Resolution string    `json:"actual_resolution"`
+	Codec      string    `json:"codec"`
+	FPS        float64   `json:"fps"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// streamInfoStore holds the latest StreamInfo per camera
+type streamInfoStore struct {
+	mu   sync.Mutex
+	info map[string]StreamInfo
+}
+
+func (st *streamInfoStore) set(cameraID string, info StreamInfo) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.info == nil {
+		st.info = make(map[string]StreamInfo)
+	}
+	st.info[cameraID] = info
+}
+
+func (st *streamInfoStore) get(cameraID string) (StreamInfo, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	info, ok := st.info[cameraID]
+	return info, ok
+}
+
+// parseVideoStream extracts codec, resolution and frame rate from an FFmpeg
+// stream description such as
+// "Stream #0:0: Video: h264 (Main), yuvj420p(pc), 1920x1080 [SAR 1:1 DAR 16:9], 25 fps, 25 tbr, 90k tbn"
+func parseVideoStream(line string) (StreamInfo, bool) {
+	m := videoStreamPattern.FindStringSubmatch(line)
+	if m == nil {
+		return StreamInfo{}, false
+	}
+
+	info := StreamInfo{Codec: m[1], UpdatedAt: time.Now()}
+	if res := resolutionPattern.FindStringSubmatch(line); res != nil {
+		info.Resolution = res[1] + "x" + res[2]
+	}
+	if fps := fpsPattern.FindStringSubmatch(line); fps != nil {
+		info.FPS, _ = strconv.ParseFloat(fps[1], 64)
+	}
+	return info, true
+}
+
+// streamInfoWriter receives FFmpeg's stderr and records the first input
+// video stream it describes. Everything after the output section starts is
+// discarded, so the stream's own encoder settings are never mistaken for
+// what the camera sends.
+type streamInfoWriter struct {
+	store    *streamInfoStore
+	cameraID string
+	buf      []byte
+	done     bool
+}
+
+func (sw *streamInfoWriter) Write(p []byte) (int, error) {
+	if sw.done {
+		return len(p), nil
+	}
+
+	sw.buf = append(sw.buf, p...)
+	for {
+		i := bytes.IndexAny(sw.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		sw.line(string(sw.buf[:i]))
+		sw.buf = sw.buf[i+1:]
+		if sw.done {
+			sw.buf = nil
+			return len(p), nil
+		}
+	}
+	if len(sw.buf) > maxStderrLine {
+		sw.buf = sw.buf[:0]
+	}
+	return len(p), nil
+}
+
+func (sw *streamInfoWriter) line(line string) {
+	if strings.HasPrefix(line, "Output #") {
+		sw.done = true
+		return
+	}
+	if info, ok := parseVideoStream(line); ok {
+		sw.store.set(sw.cameraID, info)
+		sw.done = true
+	}
+}
+
+// handleCameraFFmpeg serves /api/cameras/{id}/ffmpeg with the FFmpeg args a
+// new /stream/ transcode of the camera would use, passwords masked, for
+// debugging a camera by running FFmpeg by hand
+func (s *Server) handleCameraFFmpeg(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	cameraID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/cameras/"), "/ffmpeg")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		writeJSONError(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+
+	args := redactArgs(s.streamArgs(cameraID, streamQuality(r), camera))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      cameraID,
+		"args":    args,
+		"command": s.ffmpegCommandLine(args),
+	})
+}
+
+// handleCameraDetail serves /api/cameras/{id} with the camera's settings and
+// the stream parameters FFmpeg last reported for it
+func (s *Server) handleCameraDetail(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(r.URL.Path, "/api/cameras/")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		writeJSONError(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		writeJSONError(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		writeJSONError(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+
+	detail := map[string]interface{}{
+		"id":                cameraID,
+		"name":              camera.Name,
+		"description":       camera.Description,
+		"slug":              camera.Slug,
+		"group":             camera.Group,
+		"stream_url":        fmt.Sprintf("/stream/%s", cameraID),
+		"viewer_url":        viewerPath(cameraID, camera),
+		"qualities":         s.streamQualities(cameraID, camera),
+		"actual_resolution": nil,
+		"codec":             nil,
+		"fps":               nil,
+		"info_updated_at":   nil,
+	}
+	if info, ok := s.streamInfo.get(cameraID); ok {
+		detail["actual_resolution"] = info.Resolution
+		detail["codec"] = info.Codec
+		detail["fps"] = info.FPS
+		detail["info_updated_at"] = info.UpdatedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+	json.NewEncoder(w).Encode(detail)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClipDuration    = 30 * time.Second
+	defaultMaxClipDuration = 2 * time.Minute
+	// clipStartSlack covers connecting to the camera before the clip's
+	// duration starts counting
+	clipStartSlack = 15 * time.Second
+)
+
+// maxClipDuration returns the longest clip a request may ask for
+func (c *Config) maxClipDuration() time.Duration {
+	if c.MaxClipDuration > 0 {
+		return time.Duration(c.MaxClipDuration)
+	}
+	return defaultMaxClipDuration
+}
+
+// buildClipArgs returns FFmpeg args that record duration of the camera into
+// a regular MP4 at path. The video is copied as it arrives, and the index is
+// moved to the front so players can seek before the download finishes.
+func buildClipArgs(camera Camera, rtspURL, path string, duration time.Duration) []string {
+	args := append([]string{"-loglevel", "error"}, camera.rtspInputArgs()...)
+	args = append(args, camera.probeArgs()...)
+	args = append(args, "-i", rtspURL,
+		"-t", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64),
+		"-c:v", "copy",
+	)
+	if camera.audioDisabled() {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", "aac")
+	}
+	return append(args,
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y", path,
+	)
+}
+
+// clipFilename names a clip after the camera and the time it started, e.g.
+// "kamera-depan-20240131-154500.mp4"
+func clipFilename(camera Camera, started time.Time) string {
+	var name strings.Builder
+	for _, r := range strings.ToLower(camera.Name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			name.WriteRune(r)
+		case name.Len() > 0 && !strings.HasSuffix(name.String(), "-"):
+			name.WriteByte('-')
+		}
+	}
+	base := strings.TrimSuffix(name.String(), "-")
+	if base == "" {
+		base = "clip"
+	}
+	return base + "-" + started.Format("20060102-150405") + ".mp4"
+}
+
+func (s *Server) handleCameraClip(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(r.URL.Path, "/clip/")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+
+	duration := defaultClipDuration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "duration must be a whole number of seconds", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(n) * time.Second
+	}
+	if max := s.config.maxClipDuration(); duration > max {
+		http.Error(w, fmt.Sprintf("duration may be at most %d seconds", int(max.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	if !s.captures.acquire(s.config.maxCaptures()) {
+		s.logger.Printf("Capture limit of %d reached, rejecting clip for %s", s.config.maxCaptures(), camera.Name)
+		w.Header().Set("Retry-After", strconv.Itoa(int(duration.Seconds())))
+		http.Error(w, "Too many captures in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.captures.release()
+
+	// The moov index is written once the clip is complete, so FFmpeg needs a
+	// seekable file rather than a pipe
+	file, err := os.CreateTemp("", "camera-clip-*.mp4")
+	if err != nil {
+		s.logger.Printf("Failed to create clip file for %s: %v", camera.Name, err)
+		http.Error(w, "Failed to record clip", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// The request context stops FFmpeg if the client goes away mid-clip, and
+	// the timeout if the camera stalls
+	ctx, cancel := context.WithTimeout(r.Context(), duration+clipStartSlack)
+	defer cancel()
+
+	started := time.Now()
+	s.logger.Printf("Recording %v clip of %s for %s", duration, camera.Name, r.RemoteAddr)
+	cmd := s.ffmpegCommand(ctx, buildClipArgs(s.withCameraDefaults(camera), s.selectRTSPURL(camera), file.Name(), duration)...)
+	err = s.runFFmpeg(cmd)
+	if r.Context().Err() != nil {
+		s.logger.Printf("Client %s went away, abandoned clip of %s", r.RemoteAddr, camera.Name)
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		s.logger.Printf("Clip of %s timed out after %v", camera.Name, duration+clipStartSlack)
+		http.Error(w, "Timed out recording clip", http.StatusGatewayTimeout)
+		return
+	}
+	info, statErr := file.Stat()
+	if err != nil || statErr != nil || info.Size() == 0 {
+		s.logger.Printf("Failed to record clip of %s: %v", camera.Name, err)
+		http.Error(w, "Failed to record clip", http.StatusBadGateway)
+		return
+	}
+
+	filename := clipFilename(camera, started)
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// uncompressedPrefixes are the routes never gzipped: video streams and
+// playlists, which would be delayed or buffered, and images and clips, which
+// are compressed already
+var uncompressedPrefixes = append([]string{"/hls/", "/preview/", "/snapshot/", "/clip/", "/lastframe/", "/sprites/", "/recordings/"}, streamingPrefixes...)
+
+// gzipWriters recycles compressors, which allocate several hundred KB each
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return gz
+	},
+}
+
+// compressible reports whether a response of contentType is worth gzipping
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/javascript",
+		mediaType == "application/xml", mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body if, once the handler has set its
+// headers, the response turns out to be compressible text
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+// decide picks compression when the headers are sent
+func (gw *gzipResponseWriter) decide(status int) {
+	if gw.decided {
+		return
+	}
+	gw.decided = true
+
+	header := gw.Header()
+	if status == http.StatusNoContent || status == http.StatusNotModified || header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" || !compressible(contentType) {
+		return
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	gw.gz = gzipWriters.Get().(*gzip.Writer)
+	gw.gz.Reset(gw.ResponseWriter)
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	gw.decide(status)
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.decided {
+		// Handlers that don't set a content type get the sniffed one,
+		// as net/http would
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been compressed so far
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close finishes the gzip stream and returns the compressor to the pool
+func (gw *gzipResponseWriter) close() {
+	if gw.gz == nil {
+		return
+	}
+	gw.gz.Close()
+	gw.gz.Reset(io.Discard)
+	gzipWriters.Put(gw.gz)
+	gw.gz = nil
+}
+
+// withCompression gzips HTML, text and JSON responses for clients that
+// accept it. Streams and images are passed through untouched.
+func (s *Server) withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasAnyPrefix(r.URL.Path, uncompressedPrefixes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Caches must keep the two encodings apart even for clients that
+		// get the plain response
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connLogStats counts tunnel connections for sampled and aggregated logging
+type connLogStats struct {
+	seen      atomic.Int64
+	accepted  atomic.Int64
+	completed atomic.Int64
+	failed    atomic.Int64
+}
+
+// logConnection reports whether the next tunnel connection should be logged
+// individually. With the defaults every connection is logged.
+func (s *Server) logConnection() bool {
+	if s.config.ConnectionLogInterval > 0 {
+		return false
+	}
+	every := int64(s.config.ConnectionLogSample)
+	if every <= 1 {
+		return true
+	}
+	return s.connStats.seen.Add(1)%every == 1
+}
+
+// reportConnectionStats periodically logs aggregate tunnel connection counts
+// in place of per-connection lines
+func (s *Server) reportConnectionStats() {
+	interval := time.Duration(s.config.ConnectionLogInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			accepted := s.connStats.accepted.Swap(0)
+			completed := s.connStats.completed.Swap(0)
+			failed := s.connStats.failed.Swap(0)
+			if accepted+completed+failed == 0 {
+				continue
+			}
+			s.logger.Printf("Tunnel connections in last %v: %d accepted, %d completed, %d failed",
+				interval, accepted, completed, failed)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// ffmpegFailurePatterns map FFmpeg stderr fragments to explanations for
+// viewers, checked in order
+var ffmpegFailurePatterns = []struct {
+	match string
+	cause string
+}{
+	{"401 Unauthorized", "the camera rejected the username or password in rtsp_url (401 Unauthorized)"},
+	{"403 Forbidden", "the camera refused access to the stream (403 Forbidden)"},
+	{"404 Not Found", "the camera has no stream at the path in rtsp_url (404 Not Found)"},
+	{"Connection refused", "the camera refused the connection; check the host and RTSP port"},
+	{"Connection timed out", "timed out connecting to the camera"},
+	{"Operation timed out", "timed out connecting to the camera"},
+	{"No route to host", "the camera is unreachable (no route to host)"},
+	{"Network is unreachable", "the camera is unreachable (network is unreachable)"},
+	{"Name or service not known", "the camera's host name could not be resolved"},
+	{"Invalid data found when processing input", "the camera sent data FFmpeg could not read"},
+}
+
+// stderrDiagnoser receives FFmpeg's stderr, logs every line at debug level
+// and remembers the first line that explains why the stream failed
+type stderrDiagnoser struct {
+	log      *slog.Logger
+	cameraID string
+	buf      []byte
+
+	mu    sync.Mutex
+	cause string
+}
+
+func (d *stderrDiagnoser) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	for {
+		i := bytes.IndexAny(d.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		d.line(string(d.buf[:i]))
+		d.buf = d.buf[i+1:]
+	}
+	if len(d.buf) > maxStderrLine {
+		d.buf = d.buf[:0]
+	}
+	return len(p), nil
+}
+
+func (d *stderrDiagnoser) line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	d.log.Debug("FFmpeg output", "event", "ffmpeg_stderr", "camera_id", d.cameraID, "line", redactCredentials(line))
+
+	for _, pattern := range ffmpegFailurePatterns {
+		if strings.Contains(line, pattern.match) {
+			d.mu.Lock()
+			if d.cause == "" {
+				d.cause = pattern.cause
+			}
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// diagnosis returns the explanation found so far, or "" if none
+func (d *stderrDiagnoser) diagnosis() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cause
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSONError is http.Error for the JSON API: it replies with code and a
+// {"error": message} body
+func writeJSONError(w http.ResponseWriter, message string, code int) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// handleNotFound renders the 404 page with message and links to the cameras
+// the viewer may open, for browser pages asked for a camera that doesn't exist
+func (s *Server) handleNotFound(w http.ResponseWriter, r *http.Request, message string) {
+	data := struct {
+		Message string
+		Groups  []cameraGroup
+	}{
+		Message: message,
+		Groups:  groupCameras(s.visibleCameras(r)),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	if err := s.htmlTemplates().ExecuteTemplate(w, "not_found.html", data); err != nil {
+		s.logger.Printf("Error executing not found template: %v", err)
+	}
+}
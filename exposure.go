@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// tunnelIngressKey marks request contexts for connections that arrived through the SSH tunnel
+type tunnelIngressKey struct{}
+
+// viaTunnel reports whether r arrived through the public SSH tunnel rather than the LAN listener
+func viaTunnel(r *http.Request) bool {
+	tunneled, _ := r.Context().Value(tunnelIngressKey{}).(bool)
+	return tunneled
+}
+
+// isPublic reports whether the camera may be viewed through the public tunnel
+func (c Camera) isPublic() bool {
+	return c.PublicExposure == nil || *c.PublicExposure
+}
+
+// cameraVisible reports whether camera may be served for r
+func cameraVisible(r *http.Request, camera Camera) bool {
+	return camera.isPublic() || !viaTunnel(r)
+}
+
+// visibleCameras returns the cameras that may be listed for r
+func (s *Server) visibleCameras(r *http.Request) map[string]Camera {
+	cameras := s.cameraList()
+	for id, camera := range cameras {
+		if !cameraVisible(r, camera) || !s.cameraAllowed(r, camera) {
+			delete(cameras, id)
+		}
+	}
+	return cameras
+}
+
+// listenTunnelIngress opens the loopback listener that reverse-tunnel
+// connections are forwarded to, so requests can be told apart from LAN ones
+func (s *Server) listenTunnelIngress() (net.Listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.config.localBindAddr(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	s.tunnelIngressAddr = listener.Addr().String()
+	return listener, nil
+}
+
+// tagIngress is used as http.Server.ConnContext to mark tunnel connections
+func (s *Server) tagIngress(ctx context.Context, conn net.Conn) context.Context {
+	if s.tunnelIngressAddr != "" && conn.LocalAddr().String() == s.tunnelIngressAddr {
+		return context.WithValue(ctx, tunnelIngressKey{}, true)
+	}
+	return ctx
+}
+
+// tunnelTargetAddr returns the address reverse-tunnel connections are forwarded to
+func (s *Server) tunnelTargetAddr() string {
+	if s.config.LocalTargetAddr == "" && s.tunnelIngressAddr != "" {
+		return s.tunnelIngressAddr
+	}
+	return s.config.localTargetAddr()
+}
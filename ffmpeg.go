@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ffmpegStopGrace is how long FFmpeg gets to exit after SIGTERM before it is killed
+const ffmpegStopGrace = 2 * time.Second
+
+// ffmpegCommand is exec.CommandContext for the configured FFmpeg binary,
+// except that cancelling ctx sends SIGTERM first and only kills FFmpeg if it
+// is still running ffmpegStopGrace later. FFmpeg uses that time to finish the
+// output it is writing and to tear down its RTSP session with the camera.
+func (s *Server) ffmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, s.config.ffmpegPath(), args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = ffmpegStopGrace
+	return cmd
+}
+
+// hasFFmpeg reports whether FFmpeg was found at startup
+func (s *Server) hasFFmpeg() bool {
+	return s.ffmpegInfo != nil
+}
+
+// withFFmpeg answers 501 instead of calling next when the server started
+// without FFmpeg
+func (s *Server) withFFmpeg(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.hasFFmpeg() {
+			http.Error(w, "FFmpeg is not installed on this server", http.StatusNotImplemented)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// usesBackgroundFFmpeg reports whether any camera publishes, records or
+// builds sprite sheets, which run FFmpeg without a viewer
+func (s *Server) usesBackgroundFFmpeg() bool {
+	for _, camera := range s.config.Cameras {
+		if camera.runsInBackground() {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegCommandLine renders an FFmpeg invocation for pasting into a shell,
+// single-quoting the args that need it
+func (s *Server) ffmpegCommandLine(args []string) string {
+	var quoted []string
+	for _, arg := range append([]string{s.config.ffmpegPath()}, args...) {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`&;|<>()*?[]{}#~!") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// stopFFmpeg asks a running FFmpeg to exit with SIGTERM and kills it if it
+// hasn't within ffmpegStopGrace. It doesn't wait; the owner still calls Wait.
+func stopFFmpeg(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		// Already exited, or signals aren't supported on this platform
+		cmd.Process.Kill()
+		return
+	}
+	time.AfterFunc(ffmpegStopGrace, func() {
+		cmd.Process.Kill()
+	})
+}
+
+// Input probing defaults, much smaller than FFmpeg's own (5 MB / 5 s) so
+// live streams start quickly
+const (
+	defaultProbeSize       = 500 * 1000
+	defaultAnalyzeDuration = time.Second
+)
+
+// bufferingOptions controls how much FFmpeg buffers the RTSP input
+type bufferingOptions struct {
+	RTBufSize       string
+	ThreadQueueSize int
+	NoBuffer        bool
+}
+
+// bufferingPresets maps Camera.Buffering names to input buffering flag sets.
+// "low-latency" is the tuning every camera used before presets existed.
+var bufferingPresets = map[string]bufferingOptions{
+	"low-latency": {},
+	"smooth": {
+		RTBufSize:       "64M",
+		ThreadQueueSize: 1024,
+	},
+}
+
+// defaultBufferingPreset is used when a camera doesn't name a preset
+const defaultBufferingPreset = "low-latency"
+
+// bufferingOptions resolves the camera's preset and applies any per-camera overrides
+func (c Camera) bufferingOptions() (bufferingOptions, bool) {
+	name := c.Buffering
+	if name == "" {
+		name = defaultBufferingPreset
+	}
+
+	opts, known := bufferingPresets[name]
+	if !known {
+		opts = bufferingPresets[defaultBufferingPreset]
+	}
+
+	if c.RTBufSize != "" {
+		opts.RTBufSize = c.RTBufSize
+	}
+	if c.ThreadQueueSize > 0 {
+		opts.ThreadQueueSize = c.ThreadQueueSize
+	}
+	if c.NoBuffer != nil {
+		opts.NoBuffer = *c.NoBuffer
+	}
+	return opts, known
+}
+
+// inputArgs returns the FFmpeg input flags for these options; they must precede -i
+func (o bufferingOptions) inputArgs() []string {
+	var args []string
+	if o.RTBufSize != "" {
+		args = append(args, "-rtbufsize", o.RTBufSize)
+	}
+	if o.ThreadQueueSize > 0 {
+		args = append(args, "-thread_queue_size", strconv.Itoa(o.ThreadQueueSize))
+	}
+	if o.NoBuffer {
+		args = append(args, "-fflags", "nobuffer")
+	}
+	return args
+}
+
+// ffmpegInfo describes the FFmpeg build found at startup
+type ffmpegInfo struct {
+	Version       string   `json:"version"`
+	Configuration []string `json:"configuration"`
+}
+
+// parseFFmpegVersion extracts the version string and configure flags from `ffmpeg -version` output
+func parseFFmpegVersion(output string) *ffmpegInfo {
+	info := &ffmpegInfo{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "ffmpeg version "):
+			fields := strings.Fields(strings.TrimPrefix(line, "ffmpeg version "))
+			if len(fields) > 0 {
+				info.Version = fields[0]
+			}
+		case strings.HasPrefix(line, "configuration:"):
+			info.Configuration = strings.Fields(strings.TrimPrefix(line, "configuration:"))
+		}
+	}
+	return info
+}
+
+// validateFilters checks that the camera's filters are simple chains that can
+// be composed with the filters the server adds itself
+func (c Camera) validateFilters() error {
+	for name, chain := range map[string]string{"video_filters": c.VideoFilters, "audio_filters": c.AudioFilters} {
+		if strings.ContainsAny(chain, ";[]") {
+			return fmt.Errorf("%s must be a single filter chain without labels or ';'", name)
+		}
+		if strings.HasPrefix(strings.TrimSpace(chain), "-") {
+			return fmt.Errorf("%s must be a filter value, not an FFmpeg option", name)
+		}
+	}
+	return nil
+}
+
+// withVideoFilters prepends the camera's video filters to a server-built chain
+func (c Camera) withVideoFilters(chain string) string {
+	if c.VideoFilters == "" {
+		return chain
+	}
+	if chain == "" {
+		return c.VideoFilters
+	}
+	return c.VideoFilters + "," + chain
+}
+
+// joinFilters chains the non-empty filters in order
+func joinFilters(filters ...string) string {
+	var chain []string
+	for _, filter := range filters {
+		if filter != "" {
+			chain = append(chain, filter)
+		}
+	}
+	return strings.Join(chain, ",")
+}
+
+const defaultRTSPTimeout = 10 * time.Second
+
+// rtspTimeout returns the default socket timeout for camera inputs
+func (c *Config) rtspTimeout() time.Duration {
+	if c.RTSPTimeout > 0 {
+		return time.Duration(c.RTSPTimeout)
+	}
+	return defaultRTSPTimeout
+}
+
+// rtspTimeoutFlag returns the RTSP demuxer's socket timeout option, which
+// FFmpeg 5 renamed from -stimeout to -timeout. Before that, -timeout made
+// FFmpeg listen for an incoming stream, so unknown builds get the new name
+// only when the version can't be read at all.
+func (i *ffmpegInfo) rtspTimeoutFlag() string {
+	if i == nil {
+		return "-timeout"
+	}
+	version := strings.TrimPrefix(i.Version, "n")
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err == nil && major < 5 {
+		return "-stimeout"
+	}
+	return "-timeout"
+}
+
+// rtspTransports are the accepted rtsp_transport values
+var rtspTransports = []string{"tcp", "udp", "auto"}
+
+// validateTransport checks the camera's rtsp_transport and the UDP reorder
+// buffer settings that go with it
+func (c Camera) validateTransport() error {
+	switch c.RTSPTransport {
+	case "", "tcp", "udp", "auto":
+	default:
+		return fmt.Errorf("rtsp_transport must be one of %s, got %q", strings.Join(rtspTransports, ", "), c.RTSPTransport)
+	}
+
+	if c.JitterBuffer != "" {
+		if _, known := jitterPresets[c.JitterBuffer]; !known {
+			return fmt.Errorf("jitter_buffer must be one of low-latency, balanced or lossy, got %q", c.JitterBuffer)
+		}
+	}
+	if c.MaxDelay < 0 || c.ReorderQueueSize < 0 {
+		return fmt.Errorf("max_delay and reorder_queue_size must not be negative")
+	}
+	if !c.usesUDP() && (c.JitterBuffer != "" || c.MaxDelay > 0 || c.ReorderQueueSize > 0) {
+		return fmt.Errorf("jitter_buffer, max_delay and reorder_queue_size need rtsp_transport \"udp\" or \"auto\"; TCP delivers packets in order")
+	}
+	return nil
+}
+
+// usesUDP reports whether FFmpeg may receive the camera's RTP over UDP
+func (c Camera) usesUDP() bool {
+	return c.RTSPTransport == "udp" || c.RTSPTransport == "auto"
+}
+
+// jitterOptions controls how long FFmpeg holds RTP packets received over
+// UDP to put late and out-of-order ones back in sequence
+type jitterOptions struct {
+	MaxDelay         time.Duration
+	ReorderQueueSize int
+}
+
+// jitterPresets maps Camera.JitterBuffer names to reorder buffer settings.
+// "low-latency" spells out FFmpeg's own defaults for RTSP over UDP.
+var jitterPresets = map[string]jitterOptions{
+	"low-latency": {MaxDelay: 100 * time.Millisecond, ReorderQueueSize: 500},
+	"balanced":    {MaxDelay: 500 * time.Millisecond, ReorderQueueSize: 1000},
+	"lossy":       {MaxDelay: 2 * time.Second, ReorderQueueSize: 4000},
+}
+
+// jitterOptions resolves the camera's preset and applies any per-camera
+// overrides. The default depends on the transport: "udp" gets "balanced",
+// while "auto", which may settle on TCP, keeps FFmpeg's defaults. TCP
+// cameras get no reorder buffer at all.
+func (c Camera) jitterOptions() jitterOptions {
+	if !c.usesUDP() {
+		return jitterOptions{}
+	}
+	name := c.JitterBuffer
+	if name == "" {
+		name = "low-latency"
+		if c.RTSPTransport == "udp" {
+			name = "balanced"
+		}
+	}
+
+	opts := jitterPresets[name]
+	if c.MaxDelay > 0 {
+		opts.MaxDelay = time.Duration(c.MaxDelay)
+	}
+	if c.ReorderQueueSize > 0 {
+		opts.ReorderQueueSize = c.ReorderQueueSize
+	}
+	return opts
+}
+
+// inputArgs returns the FFmpeg input flags for these options; they must precede -i
+func (o jitterOptions) inputArgs() []string {
+	var args []string
+	if o.MaxDelay > 0 {
+		args = append(args, "-max_delay", strconv.FormatInt(o.MaxDelay.Microseconds(), 10))
+	}
+	if o.ReorderQueueSize > 0 {
+		args = append(args, "-reorder_queue_size", strconv.Itoa(o.ReorderQueueSize))
+	}
+	return args
+}
+
+// rtspInputArgs returns the flags that open the camera's RTSP input over its
+// transport, TCP unless it asks for UDP or leaves the choice to FFmpeg, with
+// the reorder buffer for UDP. The socket timeouts make FFmpeg exit when a camera stops sending, instead of
+// holding the request and the camera connection open indefinitely.
+func (c Camera) rtspInputArgs() []string {
+	var args []string
+	switch c.RTSPTransport {
+	case "auto":
+	case "udp":
+		args = append(args, "-rtsp_transport", "udp")
+	default:
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args, c.jitterOptions().inputArgs()...)
+	if c.RTSPTimeout > 0 {
+		flag := c.rtspTimeoutFlag
+		if flag == "" {
+			flag = "-timeout"
+		}
+		timeout := strconv.FormatInt(time.Duration(c.RTSPTimeout).Microseconds(), 10)
+		args = append(args, flag, timeout, "-rw_timeout", timeout)
+	}
+	return args
+}
+
+// withCameraDefaults returns camera with the global defaults filled in for
+// the settings it leaves unset, ready for the FFmpeg arg builders
+func (s *Server) withCameraDefaults(camera Camera) Camera {
+	camera = s.config.withAudioDefault(camera)
+	if camera.RTSPTimeout <= 0 {
+		camera.RTSPTimeout = Duration(s.config.rtspTimeout())
+	}
+	camera.rtspTimeoutFlag = s.ffmpegInfo.rtspTimeoutFlag()
+	return camera
+}
+
+// audioDisabled reports whether audio is left out of the camera's outputs
+func (c Camera) audioDisabled() bool {
+	return c.NoAudio != nil && *c.NoAudio
+}
+
+// withAudioDefault returns camera with no_audio taken from
+// default_no_audio when the camera doesn't set it
+func (c *Config) withAudioDefault(camera Camera) Camera {
+	if camera.NoAudio == nil {
+		noAudio := c.DefaultNoAudio
+		camera.NoAudio = &noAudio
+	}
+	return camera
+}
+
+// filterArgs returns the -vf/-af output flags for the camera's filters,
+// followed in the video chain by the quality level's scaling and the
+// encoder's upload filter if it has one
+func (c Camera) filterArgs(hw hwAccel) []string {
+	var args []string
+	if chain := c.withVideoFilters(joinFilters(c.scaleFilter(), hw.UploadFilter)); chain != "" {
+		args = append(args, "-vf", chain)
+	}
+	if c.AudioFilters != "" && !c.audioDisabled() {
+		args = append(args, "-af", c.AudioFilters)
+	}
+	return args
+}
+
+// probeArgs returns the -probesize/-analyzeduration input flags for the camera
+func (c Camera) probeArgs() []string {
+	probeSize := defaultProbeSize
+	if c.ProbeSize > 0 {
+		probeSize = c.ProbeSize
+	}
+	analyze := defaultAnalyzeDuration
+	if c.AnalyzeDuration > 0 {
+		analyze = time.Duration(c.AnalyzeDuration)
+	}
+	return []string{
+		"-probesize", strconv.Itoa(probeSize),
+		"-analyzeduration", strconv.FormatInt(analyze.Microseconds(), 10),
+	}
+}
+
+// Encoding defaults, tuned for low-latency SD/HD streams
+const (
+	defaultVideoPreset  = "ultrafast"
+	defaultCRF          = 28
+	defaultVideoBitrate = "2M"
+	defaultFramerate    = 15
+)
+
+var x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+
+// parseBitrate parses an FFmpeg-style bitrate such as "800k" or "2M" into bits per second
+func parseBitrate(value string) (int64, error) {
+	multiplier := int64(1)
+	number := value
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier, number = 1000, value[:len(value)-1]
+	case strings.HasSuffix(value, "M"):
+		multiplier, number = 1000*1000, value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q, expected e.g. \"800k\" or \"4M\"", value)
+	}
+	return n * multiplier, nil
+}
+
+// validateEncoding checks the camera's encoding overrides
+func (c Camera) validateEncoding() error {
+	if c.VideoBitrate != "" {
+		if _, err := parseBitrate(c.VideoBitrate); err != nil {
+			return fmt.Errorf("video_bitrate: %v", err)
+		}
+	}
+	if c.Framerate < 0 || c.Framerate > 120 {
+		return fmt.Errorf("framerate must be between 1 and 120")
+	}
+	if c.CRF < 0 || c.CRF > 51 {
+		return fmt.Errorf("crf must be between 1 and 51")
+	}
+	if c.Preset != "" {
+		known := false
+		for _, preset := range x264Presets {
+			known = known || preset == c.Preset
+		}
+		if !known {
+			return fmt.Errorf("preset must be one of %s", strings.Join(x264Presets, ", "))
+		}
+	}
+	return nil
+}
+
+// encodeSettings returns the camera's preset, CRF, bitrate and frame rate
+// with defaults filled in
+func (c Camera) encodeSettings() (preset string, crf int, bitrate string, framerate int) {
+	preset, crf, bitrate, framerate = defaultVideoPreset, defaultCRF, defaultVideoBitrate, defaultFramerate
+	if c.Preset != "" {
+		preset = c.Preset
+	}
+	if c.CRF > 0 {
+		crf = c.CRF
+	}
+	if c.VideoBitrate != "" {
+		bitrate = c.VideoBitrate
+	}
+	if c.Framerate > 0 {
+		framerate = c.Framerate
+	}
+	return
+}
+
+// videoArgs returns the video encoder flags for the camera on the given
+// pipeline. The rate-control buffer is two seconds of the maximum bitrate,
+// and a keyframe is forced every two seconds so fragments and segments stay
+// short.
+func (c Camera) videoArgs(hw hwAccel) []string {
+	preset, crf, bitrate, framerate := c.encodeSettings()
+	bufsize := bitrate
+	if bps, err := parseBitrate(bitrate); err == nil {
+		bufsize = strconv.FormatInt(2*bps, 10)
+	}
+
+	args := hw.videoEncodeArgs(preset, crf, bitrate, bufsize)
+	return append(args,
+		"-r", strconv.Itoa(framerate),
+		"-g", strconv.Itoa(2*framerate),
+	)
+}
+
+// encodeArgs returns the video and audio encoder flags for the camera on
+// the given pipeline, or -an in place of the audio ones with no_audio
+func (c Camera) encodeArgs(hw hwAccel) []string {
+	if c.audioDisabled() {
+		return append(c.videoArgs(hw), "-an")
+	}
+	return append(c.videoArgs(hw),
+		"-c:a", "aac",
+		"-b:a", "128k",
+	)
+}
+
+// transcodeInputArgs returns the flags up to and including -i for a
+// transcode of rtspURL on the given pipeline, with inputOptions last
+func transcodeInputArgs(camera Camera, rtspURL string, hw hwAccel, inputOptions ...string) []string {
+	buffering, _ := camera.bufferingOptions()
+
+	args := camera.rtspInputArgs()
+	args = append(args, hw.InputArgs...)
+	args = append(args, buffering.inputArgs()...)
+	args = append(args, camera.probeArgs()...)
+	args = append(args, inputOptions...)
+	return append(args, "-i", rtspURL)
+}
+
+// buildFFmpegArgs returns the args that transcode rtspURL into the
+// fragmented MP4 served by /stream/, written to stdout
+func buildFFmpegArgs(camera Camera, rtspURL string, hw hwAccel) []string {
+	args := transcodeInputArgs(camera, rtspURL, hw)
+	args = append(args, camera.filterArgs(hw)...)
+	args = append(args, camera.encodeArgs(hw)...)
+	return append(args,
+		"-f", "mp4",
+		"-movflags", "frag_keyframe+empty_moov+faststart",
+		"-reset_timestamps", "1",
+		"-avoid_negative_ts", "make_zero",
+		"-fflags", "+genpts",
+		"pipe:1",
+	)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+)
+
+const (
+	defaultConfigPath = "camera_config.json"
+	// configPathEnv names the config file when -config isn't given, so
+	// instances can share a binary and a unit file template
+	configPathEnv = "CCTV_CONFIG"
+)
+
+// defaultConfigFile returns $CCTV_CONFIG, or camera_config.json if it is unset
+func defaultConfigFile() string {
+	if path := os.Getenv(configPathEnv); path != "" {
+		return path
+	}
+	return defaultConfigPath
+}
+
+// configFlags are command-line overrides for the most commonly changed config fields
+type configFlags struct {
+	path        *string
+	vpsHost     *string
+	vpsPort     *int
+	vpsHTTPPort *int
+	localPort   *int
+	sshKey      *string
+}
+
+// registerConfigFlags defines the override flags on the default flag set
+func registerConfigFlags() *configFlags {
+	return &configFlags{
+		path:        flag.String("config", defaultConfigFile(), "path of the JSON config file, also settable with $"+configPathEnv),
+		vpsHost:     flag.String("vps-host", "", "override vps_host"),
+		vpsPort:     flag.Int("vps-port", 0, "override vps_port, the VPS SSH port"),
+		vpsHTTPPort: flag.Int("vps-http-port", 0, "override vps_http_port, the public port on the VPS"),
+		localPort:   flag.Int("local-port", 0, "override local_http_port"),
+		sshKey:      flag.String("ssh-key", "", "override ssh_key_path"),
+	}
+}
+
+// apply copies the flags that were set on the command line into config
+func (f *configFlags) apply(config *Config) {
+	flag.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "vps-host":
+			config.VPSHost = *f.vpsHost
+		case "vps-port":
+			config.VPSPort = *f.vpsPort
+		case "vps-http-port":
+			config.VPSHTTPPort = *f.vpsHTTPPort
+		case "local-port":
+			config.LocalHTTPPort = *f.localPort
+		case "ssh-key":
+			config.SSHKeyPath = pathList{*f.sshKey}
+		}
+	})
+}
+
+const redacted = "(redacted)"
+
+// redactedConfig returns the config as indented JSON with secrets and camera
+// passwords replaced, for logging
+func redactedConfig(config *Config) string {
+	c := *config
+	for _, secret := range []*string{&c.SSHKeyPEM, &c.SSHPassphrase, &c.SSHPassword, &c.AuthPasswordHash} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+
+	c.ICEServers = append([]ICEServer(nil), config.ICEServers...)
+	for i := range c.ICEServers {
+		if c.ICEServers[i].Credential != "" {
+			c.ICEServers[i].Credential = redacted
+		}
+	}
+
+	c.Cameras = make(map[string]Camera, len(config.Cameras))
+	for id, camera := range config.Cameras {
+		camera.RTSPURL = redactRTSP(camera.RTSPURL)
+		camera.FailoverURLs = append([]string(nil), camera.FailoverURLs...)
+		for i, u := range camera.FailoverURLs {
+			camera.FailoverURLs[i] = redactRTSP(u)
+		}
+		if camera.Publish != nil {
+			publish := *camera.Publish
+			publish.URL = publish.redactedDestination()
+			camera.Publish = &publish
+		}
+		c.Cameras[id] = camera
+	}
+
+	data, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
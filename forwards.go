@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ForwardConfig is one reverse port forward over the SSH connection, from a
+// port on the VPS to an address reachable from this machine
+type ForwardConfig struct {
+	Name       string `json:"name,omitempty"`       // Optional, label for logs and /api/status, defaults to "port <remote_port>"
+	RemotePort int    `json:"remote_port"`          // Port bound on the VPS
+	LocalAddr  string `json:"local_addr,omitempty"` // Optional, host:port connections are forwarded to, defaults to the built-in HTTP server
+}
+
+// validateForwards checks the ports and addresses of every forward
+func (c *Config) validateForwards() error {
+	var problems []string
+	ports := make(map[int]bool)
+	names := make(map[string]bool)
+	for i, fwd := range c.Forwards {
+		if fwd.RemotePort < 1 || fwd.RemotePort > 65535 {
+			problems = append(problems, fmt.Sprintf("forwards[%d]: remote_port must be between 1 and 65535, got %d", i, fwd.RemotePort))
+		} else if ports[fwd.RemotePort] {
+			problems = append(problems, fmt.Sprintf("forwards[%d]: remote_port %d is forwarded twice", i, fwd.RemotePort))
+		}
+		ports[fwd.RemotePort] = true
+
+		if fwd.LocalAddr != "" {
+			if _, _, err := net.SplitHostPort(fwd.LocalAddr); err != nil {
+				problems = append(problems, fmt.Sprintf("forwards[%d]: invalid local_addr %q: %v", i, fwd.LocalAddr, err))
+			}
+		}
+		if fwd.Name != "" {
+			if names[fwd.Name] {
+				problems = append(problems, fmt.Sprintf("forwards[%d]: name %q is used twice", i, fwd.Name))
+			}
+			names[fwd.Name] = true
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// tunnelForward is a forward with its defaults resolved
+type tunnelForward struct {
+	name       string
+	remotePort int
+	localAddr  string
+}
+
+// tunnelForwards returns the forwards to bind: the configured ones, or the
+// public HTTP port to the built-in server when none are configured
+func (s *Server) tunnelForwards() []tunnelForward {
+	if len(s.config.Forwards) == 0 {
+		return []tunnelForward{{name: "http", remotePort: s.config.VPSHTTPPort, localAddr: s.tunnelTargetAddr()}}
+	}
+
+	forwards := make([]tunnelForward, 0, len(s.config.Forwards))
+	for _, fwd := range s.config.Forwards {
+		resolved := tunnelForward{name: fwd.Name, remotePort: fwd.RemotePort, localAddr: fwd.LocalAddr}
+		if resolved.name == "" {
+			resolved.name = "port " + strconv.Itoa(fwd.RemotePort)
+		}
+		if resolved.localAddr == "" {
+			resolved.localAddr = s.tunnelTargetAddr()
+		}
+		forwards = append(forwards, resolved)
+	}
+	return forwards
+}
+
+// forwardStat tracks one forward across reconnects
+type forwardStat struct {
+	name       string
+	remotePort int
+	localAddr  string
+	listeners  []string // Remote addresses of the current bind, guarded by forwardStats.mu
+
+	accepted atomic.Int64
+	active   atomic.Int64
+}
+
+// forwardStats holds the stats of every forward by name
+type forwardStats struct {
+	mu    sync.Mutex
+	stats map[string]*forwardStat
+}
+
+// bound records a new bind of fwd and returns its stats
+func (f *forwardStats) bound(fwd tunnelForward, listeners []net.Listener) *forwardStat {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stats == nil {
+		f.stats = make(map[string]*forwardStat)
+	}
+	stat, ok := f.stats[fwd.name]
+	if !ok {
+		stat = &forwardStat{name: fwd.name}
+		f.stats[fwd.name] = stat
+	}
+	stat.remotePort = fwd.remotePort
+	stat.localAddr = fwd.localAddr
+	stat.listeners = stat.listeners[:0]
+	for _, listener := range listeners {
+		stat.listeners = append(stat.listeners, listener.Addr().String())
+	}
+	return stat
+}
+
+// forwardStatus is a forward as reported by /api/status
+type forwardStatus struct {
+	Name       string   `json:"name"`
+	RemotePort int      `json:"remote_port"`
+	LocalAddr  string   `json:"local_addr"`
+	Listeners  []string `json:"listeners"`
+	Accepted   int64    `json:"connections_accepted"`
+	Active     int64    `json:"connections_active"`
+}
+
+// snapshot returns every forward's status, ordered by remote port
+func (f *forwardStats) snapshot() []forwardStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	statuses := make([]forwardStatus, 0, len(f.stats))
+	for _, stat := range f.stats {
+		statuses = append(statuses, forwardStatus{
+			Name:       stat.name,
+			RemotePort: stat.remotePort,
+			LocalAddr:  stat.localAddr,
+			Listeners:  append([]string(nil), stat.listeners...),
+			Accepted:   stat.accepted.Load(),
+			Active:     stat.active.Load(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].RemotePort < statuses[j].RemotePort })
+	return statuses
+}
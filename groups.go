@@ -0,0 +1,49 @@
+package main
+
+import "sort"
+
+// cameraEntry is one camera of a group, with its ID
+type cameraEntry struct {
+	ID     string
+	Camera Camera
+}
+
+// cameraGroup is the cameras that share a group name, as rendered by the
+// main viewer
+type cameraGroup struct {
+	Name    string // Empty for cameras without a group
+	Cameras []cameraEntry
+}
+
+// groupCameras sorts cameras into groups ordered by name, with ungrouped
+// cameras last. Cameras within a group are ordered by name, then ID.
+func groupCameras(cameras map[string]Camera) []cameraGroup {
+	byName := make(map[string]*cameraGroup)
+	for id, camera := range cameras {
+		group, ok := byName[camera.Group]
+		if !ok {
+			group = &cameraGroup{Name: camera.Group}
+			byName[camera.Group] = group
+		}
+		group.Cameras = append(group.Cameras, cameraEntry{ID: id, Camera: camera})
+	}
+
+	groups := make([]cameraGroup, 0, len(byName))
+	for _, group := range byName {
+		sort.Slice(group.Cameras, func(i, j int) bool {
+			a, b := group.Cameras[i], group.Cameras[j]
+			if a.Camera.Name != b.Camera.Name {
+				return a.Camera.Name < b.Camera.Name
+			}
+			return a.ID < b.ID
+		})
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].Name == "") != (groups[j].Name == "") {
+			return groups[j].Name == ""
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = time.Minute
+	defaultProbeParallelism    = 8
+	cameraProbeTimeout         = 3 * time.Second
+	// keepaliveStaleAfter is how old the last keepalive may be before the
+	// Go tunnel is reported down; monitorSSHTunnel sends one every 10s
+	keepaliveStaleAfter = 30 * time.Second
+)
+
+// healthCheckInterval returns how often camera reachability is re-probed
+func (c *Config) healthCheckInterval() time.Duration {
+	if c.HealthCheckInterval > 0 {
+		return time.Duration(c.HealthCheckInterval)
+	}
+	return defaultHealthCheckInterval
+}
+
+// probeParallelism returns how many cameras are dialled at once
+func (c *Config) probeParallelism() int {
+	if c.ProbeParallelism > 0 {
+		return c.ProbeParallelism
+	}
+	return defaultProbeParallelism
+}
+
+// cameraProbe is the outcome of dialling one camera
+type cameraProbe struct {
+	cameraID string
+	camera   Camera
+	index    int // Which of the camera's URLs answered
+	hostPort string
+	err      error
+}
+
+// probeCameras dials every camera concurrently, at most probeParallelism at
+// a time, and returns the results sorted by camera ID so callers log and
+// report them in the same order whichever probe finished first
+func (s *Server) probeCameras(cameras map[string]Camera) []cameraProbe {
+	results := make(chan cameraProbe, len(cameras))
+	slots := make(chan struct{}, s.config.probeParallelism())
+	var wg sync.WaitGroup
+
+	for cameraID, camera := range cameras {
+		wg.Add(1)
+		go func(cameraID string, camera Camera) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			index, hostPort, err := s.probeCamera(s.ctx, camera, cameraProbeTimeout)
+			results <- cameraProbe{cameraID, camera, index, hostPort, err}
+		}(cameraID, camera)
+	}
+	wg.Wait()
+	close(results)
+
+	probes := make([]cameraProbe, 0, len(cameras))
+	for result := range results {
+		probes = append(probes, result)
+	}
+	sort.Slice(probes, func(i, j int) bool { return probes[i].cameraID < probes[j].cameraID })
+	return probes
+}
+
+// CameraStatus is the reachability history of one camera
+type CameraStatus struct {
+	Reachable   bool       `json:"reachable"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Failures    int        `json:"consecutive_failures"`
+	CheckedAt   time.Time  `json:"checked_at"`
+}
+
+// cameraHealth caches the result of the last reachability probe of each camera
+type cameraHealth struct {
+	mu        sync.Mutex
+	status    map[string]*CameraStatus
+	checkedAt time.Time
+}
+
+// record stores the outcome of one probe, reporting whether it changed the
+// camera's reachability from the previous probe
+func (h *cameraHealth) record(cameraID string, err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.status == nil {
+		h.status = make(map[string]*CameraStatus)
+	}
+	st := h.status[cameraID]
+	known := st != nil
+	if st == nil {
+		st = &CameraStatus{}
+		h.status[cameraID] = st
+	}
+
+	now := time.Now()
+	changed := known && st.Reachable != (err == nil)
+	st.CheckedAt = now
+	st.Reachable = err == nil
+	if err == nil {
+		st.LastSuccess = &now
+		st.Failures = 0
+		return changed
+	}
+	st.LastError = err.Error()
+	st.LastErrorAt = &now
+	st.Failures++
+	return changed
+}
+
+// down returns the sorted IDs of cameras whose last probe failed
+func (h *cameraHealth) down() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var down []string
+	for cameraID, st := range h.status {
+		if !st.Reachable {
+			down = append(down, cameraID)
+		}
+	}
+	sort.Strings(down)
+	return down
+}
+
+// finish marks a probe round complete and forgets cameras that were removed
+func (h *cameraHealth) finish(cameras map[string]Camera) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for cameraID := range h.status {
+		if _, ok := cameras[cameraID]; !ok {
+			delete(h.status, cameraID)
+		}
+	}
+	h.checkedAt = time.Now()
+}
+
+// get returns the sorted IDs of reachable cameras and when the last round finished
+func (h *cameraHealth) get() ([]string, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var reachable []string
+	for cameraID, st := range h.status {
+		if st.Reachable {
+			reachable = append(reachable, cameraID)
+		}
+	}
+	sort.Strings(reachable)
+	return reachable, h.checkedAt
+}
+
+// onlineState reports, for each of cameras, whether it answered its last
+// probe. Cameras not probed yet count as online.
+func (h *cameraHealth) onlineState(cameras map[string]Camera) map[string]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	online := make(map[string]bool, len(cameras))
+	for cameraID := range cameras {
+		st, probed := h.status[cameraID]
+		online[cameraID] = !probed || st.Reachable
+	}
+	return online
+}
+
+// listedCameras returns the cameras the main viewer and /api/cameras show
+// the requester: the visible ones, less those currently unreachable when
+// hide_offline_cameras is set. A camera that recovers is listed again
+// after the next health check.
+func (s *Server) listedCameras(r *http.Request) map[string]Camera {
+	cameras := s.visibleCameras(r)
+	if !s.config.HideOfflineCameras {
+		return cameras
+	}
+	for cameraID, online := range s.cameraHealth.onlineState(cameras) {
+		if !online {
+			delete(cameras, cameraID)
+		}
+	}
+	return cameras
+}
+
+// statuses returns a copy of every camera's status
+func (h *cameraHealth) statuses() map[string]CameraStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string]CameraStatus, len(h.status))
+	for cameraID, st := range h.status {
+		out[cameraID] = *st
+	}
+	return out
+}
+
+// runHealthChecks re-probes every camera on an interval so /healthz and
+// /api/cameras/status never have to dial cameras themselves
+func (s *Server) runHealthChecks() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.healthCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Idle shutdown stops dialling the cameras too
+		if s.quiesced.Load() {
+			continue
+		}
+
+		cameras := s.cameraList()
+		changed := false
+		for _, result := range s.probeCameras(cameras) {
+			if !s.cameraHealth.record(result.cameraID, result.err) {
+				continue
+			}
+			changed = true
+			if result.err == nil {
+				s.logger.Printf("Camera %s is reachable again (%s)", result.camera.Name, result.hostPort)
+			} else {
+				s.logger.Printf("Camera %s became unreachable: %v", result.camera.Name, result.err)
+			}
+		}
+		s.cameraHealth.finish(cameras)
+		if down := s.cameraHealth.down(); changed && len(down) > 0 {
+			s.logger.Printf("Cameras down: %s", strings.Join(down, ", "))
+		}
+	}
+}
+
+// handleCameraStatuses serves /api/cameras/status from the health checker's
+// cache, limited to the cameras the requester may see
+func (s *Server) handleCameraStatuses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := s.cameraHealth.statuses()
+	body := make(map[string]CameraStatus)
+	for cameraID := range s.visibleCameras(r) {
+		if st, ok := statuses[cameraID]; ok {
+			body[cameraID] = st
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(body)
+}
+
+// tunnelState describes the reverse tunnel for /healthz
+func (s *Server) tunnelState() string {
+	switch {
+	case s.tunnelIdle.Load():
+		return "idle"
+	case s.currentTunnelMode() == tunnelSystemSSH:
+		if s.systemSSHExited.Load() {
+			return "disconnected"
+		}
+		return "connected"
+	case s.currentTunnelMode() == tunnelGoSSH && s.currentTunnel() != nil &&
+		time.Since(time.Unix(0, s.lastKeepalive.Load())) < keepaliveStaleAfter:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// handleHealthz reports 200 when the tunnel is up and at least one camera is
+// reachable, 503 otherwise
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	reachable, checkedAt := s.cameraHealth.get()
+	tunnel := s.tunnelState()
+
+	body := map[string]interface{}{
+		"tunnel":            tunnel,
+		"tunnel_method":     s.currentTunnelMode().String(),
+		"cameras_total":     len(s.cameraList()),
+		"cameras_reachable": len(reachable),
+		"reachable":         reachable,
+		"cameras_checked":   checkedAt,
+		"ffmpeg":            s.hasFFmpeg(),
+		"hls_disk_bytes":    hlsTotal(s.hlsDiskUsage()),
+	}
+	if keepalive := s.lastKeepalive.Load(); keepalive > 0 {
+		body["last_keepalive"] = time.Unix(0, keepalive)
+	}
+
+	healthy := tunnel == "connected" && len(reachable) > 0
+	body["status"] = "ok"
+	status := http.StatusOK
+	if !healthy {
+		body["status"] = "unhealthy"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
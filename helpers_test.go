@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeFFmpeg writes a stand-in for FFmpeg that sends an ftyp box, a moov
+// box and then a fragment every 50ms until it is stopped. On SIGTERM it
+// creates path+".terminated" and exits. setMoov changes the moov payload
+// later FFmpeg runs send; it starts out empty.
+func fakeFFmpeg(t *testing.T) (path string, setMoov func(payload string)) {
+	t.Helper()
+	dir := t.TempDir()
+	moov := filepath.Join(dir, "moov")
+	setMoov = func(payload string) {
+		t.Helper()
+		box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+		box = append(box, "moov"+payload...)
+		if err := os.WriteFile(moov, box, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setMoov("")
+
+	path = filepath.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\ntrap 'touch \"$0.terminated\"; exit 0' TERM\nprintf '\\000\\000\\000\\010ftyp'\ncat " + moov + "\nwhile true; do printf '\\000\\000\\000\\010moof\\000\\000\\000\\014mdatDATA' || exit 0; sleep 0.05; done\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, setMoov
+}
+
+// testAPIServer is a Server behind an httptest server, with admin
+// credentials admin and secret
+type testAPIServer struct {
+	*Server
+	URL string
+}
+
+// newTestAPIServer sets config's admin credentials and serves it until the
+// test ends
+func newTestAPIServer(t *testing.T, config *Config) *testAPIServer {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AuthUsername = "admin"
+	config.AuthPasswordHash = string(hash)
+
+	s := NewServer(config)
+	s.logger.SetOutput(&syncBuffer{})
+	s.ffmpegInfo = &ffmpegInfo{Version: "test"}
+	t.Cleanup(s.Stop)
+
+	server := httptest.NewServer(s.setupRoutes())
+	t.Cleanup(server.Close)
+	return &testAPIServer{Server: s, URL: server.URL}
+}
+
+// request sends an admin request with body, which may be empty
+func (ts *testAPIServer) request(method, path, body string) (*http.Response, error) {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("admin", "secret")
+	return http.DefaultClient.Do(req)
+}
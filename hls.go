@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHLSIdleTimeout = 30 * time.Second
+	defaultHLSMaxSegments = 5
+	defaultHLSMaxMB       = 100
+	hlsPlaylist           = "playlist.m3u8"
+	// hlsMasterPlaylist lists one variant playlist per quality level
+	hlsMasterPlaylist = "master.m3u8"
+	// hlsAudioBitrate is the AAC bitrate encodeArgs sets, in bits/s
+	hlsAudioBitrate = 128000
+	// hlsDirPrefix starts the name of every transcode's segment directory
+	hlsDirPrefix = "camera-tunnel-hls-"
+	// hlsStartTimeout is how long the first request waits for FFmpeg to write a playlist
+	hlsStartTimeout = 20 * time.Second
+	// hlsOrphanAge is how long a segment directory must go unmodified before
+	// the startup sweep removes it. A running transcode rewrites its playlist
+	// every segment, so directories of another running instance are kept.
+	hlsOrphanAge = time.Minute
+)
+
+var hlsSegmentPattern = regexp.MustCompile(`^segment_\d+\.ts$`)
+
+// hlsIdleTimeout returns how long an HLS transcode keeps running without requests
+func (c *Config) hlsIdleTimeout() time.Duration {
+	if c.HLSIdleTimeout > 0 {
+		return time.Duration(c.HLSIdleTimeout)
+	}
+	return defaultHLSIdleTimeout
+}
+
+// hlsDir returns the directory HLS segment directories are created in
+func (c *Config) hlsDir() string {
+	if c.HLSDir != "" {
+		return c.HLSDir
+	}
+	return os.TempDir()
+}
+
+// hlsMaxSegments returns how many segments a camera's transcode keeps on disk
+func (c *Config) hlsMaxSegments() int {
+	if c.HLSMaxSegments > 0 {
+		return c.HLSMaxSegments
+	}
+	return defaultHLSMaxSegments
+}
+
+// hlsMaxBytes returns the cap on the segments of one camera's transcode
+func (c *Config) hlsMaxBytes() int64 {
+	mb := c.HLSMaxMB
+	if mb <= 0 {
+		mb = defaultHLSMaxMB
+	}
+	return mb * 1024 * 1024
+}
+
+// hlsSession is one running HLS transcode shared by every viewer of a
+// camera at one quality level
+type hlsSession struct {
+	dir        string
+	cmd        *exec.Cmd
+	lastAccess atomic.Int64 // Unix nanoseconds
+	diskBytes  atomic.Int64 // Size of the segments, updated by superviseHLS
+	done       chan struct{}
+}
+
+func (h *hlsSession) touch() {
+	h.lastAccess.Store(time.Now().UnixNano())
+}
+
+// hlsSessions tracks the running HLS transcodes by camera and quality
+type hlsSessions struct {
+	mu       sync.Mutex
+	sessions map[streamKey]*hlsSession
+}
+
+// buildHLSArgs returns FFmpeg args that transcode the camera into a rolling
+// HLS playlist of segments segments in dir. Each quality level's variant is
+// its own transcode, started when first requested, so timestamps come from
+// the wall clock and are kept through the transcode, and every segment is
+// tagged with EXT-X-PROGRAM-DATE-TIME: the variants share one timeline
+// rather than each starting at zero.
+func buildHLSArgs(camera Camera, rtspURL, dir string, hw hwAccel, segments int) []string {
+	args := transcodeInputArgs(camera, rtspURL, hw, "-use_wallclock_as_timestamps", "1")
+	args = append(args, camera.filterArgs(hw)...)
+	args = append(args, camera.encodeArgs(hw)...)
+	return append(args,
+		"-copyts",
+		"-f", "hls",
+		"-hls_time", "2",
+		"-hls_list_size", strconv.Itoa(segments),
+		"-hls_flags", "delete_segments+program_date_time",
+		"-hls_segment_filename", filepath.Join(dir, "segment_%05d.ts"),
+		filepath.Join(dir, hlsPlaylist),
+	)
+}
+
+// hlsSession returns the running transcode for key, starting one if needed
+func (s *Server) hlsSession(key streamKey, camera Camera) (*hlsSession, error) {
+	s.hls.mu.Lock()
+	session, ok := s.hls.sessions[key]
+	s.hls.mu.Unlock()
+	if ok {
+		return session, nil
+	}
+
+	// Picking the RTSP URL may probe unreachable failover URLs, so it runs
+	// without the lock every HLS request needs
+	rtspURL := s.selectRTSPURL(camera)
+
+	s.hls.mu.Lock()
+	defer s.hls.mu.Unlock()
+	// Another request may have started it in the meantime
+	if session, ok := s.hls.sessions[key]; ok {
+		return session, nil
+	}
+
+	dir, err := os.MkdirTemp(s.config.hlsDir(), hlsDirPrefix+key.cameraID+"-"+key.quality+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HLS directory: %v", err)
+	}
+
+	encoded := s.withCameraDefaults(camera).withQuality(s.config.qualityProfile(key.quality))
+	session = &hlsSession{
+		dir:  dir,
+		cmd:  s.ffmpegCommand(s.ctx, buildHLSArgs(encoded, rtspURL, dir, s.hwAccel, s.config.hlsMaxSegments())...),
+		done: make(chan struct{}),
+	}
+	session.cmd.Stderr = &streamInfoWriter{store: &s.streamInfo, cameraID: key.cameraID}
+	session.touch()
+	if err := s.startFFmpeg(session.cmd); err != nil {
+		os.RemoveAll(dir)
+		s.metrics.ffmpegFailed(key.cameraID, "hls")
+		return nil, fmt.Errorf("failed to start FFmpeg: %v", err)
+	}
+	s.metrics.ffmpegStarted(key.cameraID, "hls")
+
+	if s.hls.sessions == nil {
+		s.hls.sessions = make(map[streamKey]*hlsSession)
+	}
+	s.hls.sessions[key] = session
+	s.logger.Printf("Started %s HLS transcode for %s (%s)", key.quality, camera.Name, key.cameraID)
+
+	s.activeStreams.Add(1)
+	s.wg.Add(1)
+	go s.superviseHLS(key, camera, session)
+	return session, nil
+}
+
+// superviseHLS stops the transcode once no viewer has requested it for the
+// idle timeout, and cleans up after FFmpeg exits for any reason
+func (s *Server) superviseHLS(key streamKey, camera Camera, session *hlsSession) {
+	defer s.wg.Done()
+
+	unregister := s.work.add(fmt.Sprintf("%s %s HLS transcode", key.cameraID, key.quality), closerFunc(func() error {
+		return session.cmd.Process.Kill()
+	}))
+
+	exited := make(chan error, 1)
+	go func() { exited <- session.cmd.Wait() }()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for running := true; running; {
+		select {
+		case err := <-exited:
+			if s.ctx.Err() == nil {
+				s.logger.Printf("%s HLS transcode for %s exited: %v", key.quality, camera.Name, err)
+				if err != nil {
+					s.metrics.ffmpegFailed(key.cameraID, "hls")
+				}
+			}
+			running = false
+		case <-ticker.C:
+			s.limitHLSSegments(camera, session)
+			idle := time.Since(time.Unix(0, session.lastAccess.Load()))
+			if idle >= s.config.hlsIdleTimeout() {
+				s.logger.Printf("No %s HLS viewers for %s in %v, stopping transcode", key.quality, camera.Name, idle.Round(time.Second))
+				stopFFmpeg(session.cmd)
+				<-exited
+				running = false
+			}
+		}
+	}
+
+	s.hls.mu.Lock()
+	if s.hls.sessions[key] == session {
+		delete(s.hls.sessions, key)
+	}
+	s.hls.mu.Unlock()
+
+	unregister()
+	close(session.done)
+	os.RemoveAll(session.dir)
+	s.activeStreams.Add(-1)
+	s.markActivity()
+}
+
+// limitHLSSegments deletes the session's oldest segments beyond the
+// configured count and size, which FFmpeg's own deletion doesn't bound when
+// segments are large or it falls behind, and records the size left
+func (s *Server) limitHLSSegments(camera Camera, session *hlsSession) {
+	removed, total, err := pruneHLSSegments(session.dir, s.config.hlsMaxSegments(), s.config.hlsMaxBytes())
+	if err != nil {
+		s.logger.Printf("Failed to prune HLS segments for %s: %v", camera.Name, err)
+	} else if removed > 0 {
+		s.logger.Printf("Pruned %d HLS segment(s) for %s to stay under %d segments and %d MB",
+			removed, camera.Name, s.config.hlsMaxSegments(), s.config.hlsMaxBytes()/(1024*1024))
+	}
+	session.diskBytes.Store(total)
+}
+
+// pruneHLSSegments deletes the oldest segments in dir while there are more
+// than max of them, not counting the one being written, or they total more
+// than limit, and returns how many it removed and the size of the rest. The
+// newest segment is never removed because FFmpeg is still writing it.
+func pruneHLSSegments(dir string, max int, limit int64) (int, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type segment struct {
+		path string
+		size int64
+	}
+	var segments []segment
+	var total int64
+	for _, entry := range entries {
+		if !hlsSegmentPattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{filepath.Join(dir, entry.Name()), info.Size()})
+		total += info.Size()
+	}
+	// Numbered names sort oldest first
+	sort.Slice(segments, func(i, j int) bool { return segments[i].path < segments[j].path })
+
+	removed := 0
+	for i := 0; i < len(segments)-1 && (len(segments)-i > max+1 || total > limit); i++ {
+		if err := os.Remove(segments[i].path); err != nil && !os.IsNotExist(err) {
+			return removed, total, err
+		}
+		total -= segments[i].size
+		removed++
+	}
+	return removed, total, nil
+}
+
+// hlsDiskUsage returns the segment bytes of each camera's running HLS
+// transcodes, summed over its quality levels
+func (s *Server) hlsDiskUsage() map[string]int64 {
+	s.hls.mu.Lock()
+	defer s.hls.mu.Unlock()
+	usage := make(map[string]int64, len(s.hls.sessions))
+	for key, session := range s.hls.sessions {
+		usage[key.cameraID] += session.diskBytes.Load()
+	}
+	return usage
+}
+
+// hlsTotal sums the per-camera usage from hlsDiskUsage
+func hlsTotal(usage map[string]int64) int64 {
+	var total int64
+	for _, n := range usage {
+		total += n
+	}
+	return total
+}
+
+// sweepHLSDirs removes segment directories left in the HLS directory by a
+// previous run that didn't shut down cleanly
+func (s *Server) sweepHLSDirs() {
+	root := s.config.hlsDir()
+	if err := os.MkdirAll(root, 0755); err != nil {
+		s.logger.Printf("Warning: could not create HLS directory %s: %v", root, err)
+		return
+	}
+	dirs, err := filepath.Glob(filepath.Join(root, hlsDirPrefix+"*"))
+	if err != nil {
+		return
+	}
+
+	removed := 0
+	var freed int64
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < hlsOrphanAge {
+			continue
+		}
+		size := dirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			s.logger.Printf("Failed to remove orphaned HLS directory %s: %v", dir, err)
+			continue
+		}
+		removed++
+		freed += size
+	}
+	if removed > 0 {
+		s.logger.Printf("Removed %d orphaned HLS director(ies) from %s, freeing %d MB", removed, root, freed/(1024*1024))
+	}
+}
+
+// dirSize returns the total size of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// waitForPlaylist blocks until FFmpeg has written the first playlist
+func (h *hlsSession) waitForPlaylist(r *http.Request) bool {
+	deadline := time.NewTimer(hlsStartTimeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(200 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		if _, err := os.Stat(filepath.Join(h.dir, hlsPlaylist)); err == nil {
+			return true
+		}
+		select {
+		case <-poll.C:
+		case <-h.done:
+			return false
+		case <-deadline.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// hlsMasterPlaylistFor returns the camera's master playlist: one variant
+// per quality level, the default first since players start with it, with
+// the peak bitrate its encoder is capped at and, where it can be worked
+// out, its resolution. Variant URIs are relative to /hls/{id}/.
+func (s *Server) hlsMasterPlaylistFor(cameraID string, camera Camera) string {
+	info, _ := s.streamInfo.get(cameraID)
+
+	levels := []string{defaultQuality}
+	for _, level := range qualityLevels {
+		if level != defaultQuality {
+			levels = append(levels, level)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, level := range levels {
+		encoded := s.withCameraDefaults(camera).withQuality(s.config.qualityProfile(level))
+		_, _, bitrate, _ := encoded.encodeSettings()
+		// Validated at load time, so this only fails for a bad default
+		bandwidth, _ := parseBitrate(bitrate)
+		if !encoded.audioDisabled() {
+			bandwidth += hlsAudioBitrate
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+		if resolution := variantResolution(info.Resolution, s.config.qualityProfile(level).Height); resolution != "" {
+			fmt.Fprintf(&b, ",RESOLUTION=%s", resolution)
+		}
+		fmt.Fprintf(&b, "\n%s/%s\n", level, hlsPlaylist)
+	}
+	return b.String()
+}
+
+// variantResolution returns the WIDTHxHEIGHT of a variant scaled to at most
+// maxHeight, keeping the aspect ratio with an even width as scaleFilter
+// does. actual is the camera's resolution as FFmpeg last reported it; until
+// a stream has started it isn't known, and a scaled variant is assumed to be
+// 16:9 while an unscaled one is left without a resolution.
+func variantResolution(actual string, maxHeight int) string {
+	var width, height int
+	_, err := fmt.Sscanf(actual, "%dx%d", &width, &height)
+	known := err == nil && width > 0 && height > 0
+	switch {
+	case !known && maxHeight <= 0:
+		return ""
+	case !known:
+		width, height = 16, 9
+	case maxHeight <= 0 || maxHeight >= height:
+		return fmt.Sprintf("%dx%d", width, height)
+	}
+	width = int(math.Round(float64(width)*float64(maxHeight)/float64(height)/2)) * 2
+	return fmt.Sprintf("%dx%d", width, maxHeight)
+}
+
+// hlsRequest splits the path after /hls/{id}/ into the quality level and
+// file it asks for. {quality}/playlist.m3u8 and its segments are the
+// variants of the master playlist; playlist.m3u8 and its segments directly
+// under the camera are the default quality.
+func hlsRequest(path string) (quality, file string, ok bool) {
+	quality, file = defaultQuality, path
+	if level, rest, found := strings.Cut(path, "/"); found {
+		if _, known := defaultQualityProfiles[level]; !known {
+			return "", "", false
+		}
+		quality, file = level, rest
+	}
+	if file != hlsPlaylist && !hlsSegmentPattern.MatchString(file) {
+		return "", "", false
+	}
+	return quality, file, true
+}
+
+// handleHLS serves /hls/{id}/master.m3u8, the variant playlists it lists,
+// /hls/{id}/playlist.m3u8 and the segments they reference
+func (s *Server) handleHLS(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/hls/"), "/", 2)
+	cameraID := parts[0]
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+	if len(parts) == 2 && parts[1] == hlsMasterPlaylist {
+		// Players switch between the variants themselves, each of which
+		// starts its transcode when first requested
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		io.WriteString(w, s.hlsMasterPlaylistFor(cameraID, camera))
+		return
+	}
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	quality, file, ok := hlsRequest(parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key := streamKey{cameraID: cameraID, quality: quality}
+
+	if file != hlsPlaylist {
+		// Segments are only valid for a transcode that is already running
+		s.hls.mu.Lock()
+		session, ok := s.hls.sessions[key]
+		s.hls.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		session.touch()
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, filepath.Join(session.dir, file))
+		return
+	}
+
+	session, err := s.hlsSession(key, camera)
+	if err != nil {
+		s.logger.Printf("Failed to start HLS for %s: %v", camera.Name, err)
+		http.Error(w, "Failed to start stream", http.StatusInternalServerError)
+		return
+	}
+	session.touch()
+
+	if !session.waitForPlaylist(r) {
+		http.Error(w, "Stream is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, filepath.Join(session.dir, hlsPlaylist))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneHLSSegments(t *testing.T) {
+	tests := []struct {
+		name        string
+		sizes       []int
+		max         int
+		limit       int64
+		wantRemoved int
+		wantKept    []string
+	}{
+		{name: "within limits", sizes: []int{10, 10, 10}, max: 5, limit: 100, wantRemoved: 0, wantKept: []string{"segment_00000.ts", "segment_00001.ts", "segment_00002.ts"}},
+		{name: "over count", sizes: []int{10, 10, 10, 10}, max: 2, limit: 100, wantRemoved: 1, wantKept: []string{"segment_00001.ts", "segment_00002.ts", "segment_00003.ts"}},
+		{name: "over size", sizes: []int{40, 40, 40}, max: 5, limit: 50, wantRemoved: 2, wantKept: []string{"segment_00002.ts"}},
+		{name: "newest kept over size", sizes: []int{200}, max: 5, limit: 50, wantRemoved: 0, wantKept: []string{"segment_00000.ts"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i, size := range tt.sizes {
+				if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("segment_%05d.ts", i)), make([]byte, size), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(dir, hlsPlaylist), []byte("#EXTM3U\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			removed, total, err := pruneHLSSegments(dir, tt.max, tt.limit)
+			if err != nil {
+				t.Fatalf("pruneHLSSegments: %v", err)
+			}
+			if removed != tt.wantRemoved {
+				t.Errorf("removed %d segments, want %d", removed, tt.wantRemoved)
+			}
+
+			kept, _ := filepath.Glob(filepath.Join(dir, "segment_*.ts"))
+			var names []string
+			var size int64
+			for _, path := range kept {
+				names = append(names, filepath.Base(path))
+				info, _ := os.Stat(path)
+				size += info.Size()
+			}
+			sort.Strings(names)
+			if fmt.Sprint(names) != fmt.Sprint(tt.wantKept) {
+				t.Errorf("kept %v, want %v", names, tt.wantKept)
+			}
+			if total != size {
+				t.Errorf("reported %d bytes left, %d on disk", total, size)
+			}
+			if _, err := os.Stat(filepath.Join(dir, hlsPlaylist)); err != nil {
+				t.Errorf("playlist was removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSweepHLSDirs(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-2 * hlsOrphanAge)
+
+	orphan := filepath.Join(root, hlsDirPrefix+"front-123")
+	active := filepath.Join(root, hlsDirPrefix+"back-456")
+	unrelated := filepath.Join(root, "other-789")
+	for _, dir := range []string{orphan, active, unrelated} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "segment_00000.ts"), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{orphan, unrelated} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewServer(&Config{HLSDir: root})
+	s.logger.SetOutput(&syncBuffer{})
+	s.sweepHLSDirs()
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned directory was kept: %v", err)
+	}
+	for _, dir := range []string{active, unrelated} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("%s was removed: %v", filepath.Base(dir), err)
+		}
+	}
+}
+
+// TestHLSQualityVariants checks that the master playlist lists a variant
+// per quality level and that each variant runs its own transcode with that
+// level's encoding, on the wall-clock timeline the others use
+func TestHLSQualityVariants(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	// Writes a playlist to its last argument and runs until stopped
+	script := "#!/bin/sh\nfor last; do :; done\necho \"$@\" >> " + argsFile + "\nprintf '#EXTM3U\\n' > \"$last\"\ntrap 'exit 0' TERM\nwhile true; do sleep 0.05; done\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestAPIServer(t, &Config{
+		FFmpegPath:      ffmpeg,
+		SkipPreflight:   true,
+		HLSDir:          t.TempDir(),
+		QualityProfiles: map[string]QualityProfile{"low": {Height: 240, VideoBitrate: "300k"}},
+		Cameras: map[string]Camera{
+			"front": {Name: "Front", RTSPURL: "rtsp://127.0.0.1:1/front"},
+		},
+	})
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := s.request(http.MethodGet, path, "")
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, master := get("/hls/front/master.m3u8")
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2128000\nmedium/playlist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=428000,RESOLUTION=426x240\nlow/playlist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=4128000\nhigh/playlist.m3u8\n"
+	if status != http.StatusOK || master != want {
+		t.Errorf("master playlist returned %d:\n%s\nwant:\n%s", status, master, want)
+	}
+
+	// Once FFmpeg has reported the camera's resolution every variant has one
+	s.streamInfo.set("front", StreamInfo{Resolution: "1280x960"})
+	_, master = get("/hls/front/master.m3u8")
+	for _, resolution := range []string{"BANDWIDTH=2128000,RESOLUTION=1280x960\n", "BANDWIDTH=428000,RESOLUTION=320x240\n", "BANDWIDTH=4128000,RESOLUTION=1280x960\n"} {
+		if !strings.Contains(master, resolution) {
+			t.Errorf("master playlist lacks %q:\n%s", resolution, master)
+		}
+	}
+
+	if status, body := get("/hls/front/low/playlist.m3u8"); status != http.StatusOK || body != "#EXTM3U\n" {
+		t.Fatalf("low variant returned %d: %q", status, body)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"300k", "min(240,ih)", "-use_wallclock_as_timestamps 1 -i", "-copyts", "delete_segments+program_date_time"} {
+		if !strings.Contains(string(args), arg) {
+			t.Errorf("low variant args lack %s: %s", arg, args)
+		}
+	}
+
+	for _, path := range []string{"/hls/front/ultra/playlist.m3u8", "/hls/front/high/segment_00000.ts", "/hls/front/low/other.txt"} {
+		if status, _ := get(path); status != http.StatusNotFound {
+			t.Errorf("GET %s returned %d, want 404", path, status)
+		}
+	}
+
+	s.hls.mu.Lock()
+	var running []string
+	for key := range s.hls.sessions {
+		running = append(running, key.cameraID+"/"+key.quality)
+	}
+	s.hls.mu.Unlock()
+	if fmt.Sprint(running) != "[front/low]" {
+		t.Errorf("running HLS transcodes %v, want [front/low]", running)
+	}
+}
+
+func TestVariantResolution(t *testing.T) {
+	tests := []struct {
+		actual    string
+		maxHeight int
+		want      string
+	}{
+		{actual: "1920x1080", maxHeight: 0, want: "1920x1080"},
+		{actual: "1920x1080", maxHeight: 360, want: "640x360"},
+		{actual: "1920x1080", maxHeight: 2160, want: "1920x1080"},
+		{actual: "704x576", maxHeight: 240, want: "294x240"},
+		{actual: "", maxHeight: 0, want: ""},
+		{actual: "", maxHeight: 360, want: "640x360"},
+		{actual: "garbage", maxHeight: 360, want: "640x360"},
+	}
+	for _, tt := range tests {
+		if got := variantResolution(tt.actual, tt.maxHeight); got != tt.want {
+			t.Errorf("variantResolution(%q, %d) = %q, want %q", tt.actual, tt.maxHeight, got, tt.want)
+		}
+	}
+}
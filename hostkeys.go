@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultKnownHostsPath = "~/.ssh/known_hosts"
+
+// knownHostsMu serialises appends to the known_hosts file
+var knownHostsMu sync.Mutex
+
+// knownHostsPath returns the known_hosts file used by both tunnel modes
+func (s *Server) knownHostsPath() string {
+	if s.config.KnownHostsPath != "" {
+		return s.expandPath(s.config.KnownHostsPath)
+	}
+	return s.expandPath(defaultKnownHostsPath)
+}
+
+// strictHostKeyChecking returns the StrictHostKeyChecking value for the
+// system ssh fallback, matching what hostKeyCallback enforces
+func (s *Server) strictHostKeyChecking() string {
+	switch {
+	case s.config.InsecureSkipHostKeyCheck:
+		return "no"
+	case s.config.TrustOnFirstUse:
+		return "accept-new"
+	default:
+		return "yes"
+	}
+}
+
+// hostKeyCallback verifies the VPS host key against known_hosts. Unknown
+// hosts are rejected unless TrustOnFirstUse is set, in which case the key is
+// recorded; a changed key of a type already recorded is always rejected.
+func (s *Server) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if s.config.InsecureSkipHostKeyCheck {
+		s.logger.Println("WARNING: SSH host key verification is disabled")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	path := s.knownHostsPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create known_hosts directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open known_hosts %s: %v", path, err)
+	}
+	f.Close()
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts %s: %v", path, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if pinsKeyType(keyErr.Want, key.Type()) {
+			return fmt.Errorf("host key for %s has changed (now %s %s), possible man-in-the-middle attack; remove the old entry from %s if the change is expected",
+				hostname, key.Type(), fingerprint, path)
+		}
+
+		// Keys of other types only, as when the server offers one the dial
+		// didn't ask for: this type isn't pinned yet, so it's a new key
+		s.logger.Printf("Unknown SSH host key for %s: %s %s", hostname, key.Type(), fingerprint)
+		if !s.config.TrustOnFirstUse {
+			return fmt.Errorf("host key for %s is not in %s; verify the fingerprint and add it, or set trust_on_first_use", hostname, path)
+		}
+		if err := appendKnownHost(path, hostname, key); err != nil {
+			return fmt.Errorf("failed to record host key: %v", err)
+		}
+		s.logger.Printf("Trusted host key for %s on first use, added to %s", hostname, path)
+		return nil
+	}, nil
+}
+
+// pinsKeyType reports whether known holds a key of keyType
+func pinsKeyType(known []knownhosts.KnownKey, keyType string) bool {
+	for _, k := range known {
+		if k.Key.Type() == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms for the key types
+// known_hosts records for address, so the server is asked for a key that can
+// be verified rather than the type x/crypto prefers. It returns nil, keeping
+// the default order, when nothing is recorded for address.
+func (s *Server) knownHostKeyAlgorithms(address string) []string {
+	if s.config.InsecureSkipHostKeyCheck {
+		return nil
+	}
+	callback, err := knownhosts.New(s.knownHostsPath())
+	if err != nil {
+		return nil
+	}
+
+	// A fresh key matches no entry, so the error lists every recorded one
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	placeholder, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(address, &net.TCPAddr{IP: net.IPv4zero}, placeholder), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		keyType := known.Key.Type()
+		candidates := []string{keyType}
+		if keyType == ssh.KeyAlgoRSA {
+			// An RSA key can sign with any of these
+			candidates = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, algorithm := range candidates {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+// appendKnownHost adds a known_hosts entry for hostname
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
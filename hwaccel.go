@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hwAccel describes one video encoding pipeline
+type hwAccel struct {
+	Name    string
+	Encoder string
+	// InputArgs precede -i: hardware decoding or the device the encoder uses
+	InputArgs []string
+	// UploadFilter ends the video filter chain, converting frames into
+	// what the encoder accepts
+	UploadFilter string
+}
+
+// softwareEncoding is the libx264 pipeline every camera used before hw_accel existed
+var softwareEncoding = hwAccel{Name: "none", Encoder: "libx264"}
+
+// hwAccels maps Config.HWAccel names to their pipelines. Decoding stays in
+// software except for NVDEC, so camera filters keep working on plain frames.
+var hwAccels = map[string]hwAccel{
+	"none": softwareEncoding,
+	"nvenc": {
+		Name:      "nvenc",
+		Encoder:   "h264_nvenc",
+		InputArgs: []string{"-hwaccel", "cuda"},
+	},
+	"vaapi": {
+		Name:         "vaapi",
+		Encoder:      "h264_vaapi",
+		InputArgs:    []string{"-vaapi_device", "/dev/dri/renderD128"},
+		UploadFilter: "format=nv12,hwupload",
+	},
+	"qsv": {
+		Name:         "qsv",
+		Encoder:      "h264_qsv",
+		UploadFilter: "format=nv12",
+	},
+}
+
+// validateHWAccel checks that HWAccel names a known pipeline
+func (c *Config) validateHWAccel() error {
+	if c.HWAccel == "" {
+		return nil
+	}
+	if _, ok := hwAccels[c.HWAccel]; !ok {
+		names := make([]string, 0, len(hwAccels))
+		for name := range hwAccels {
+			names = append(names, fmt.Sprintf("%q", name))
+		}
+		sort.Strings(names)
+		return fmt.Errorf("hw_accel must be one of %s, got %q", strings.Join(names, ", "), c.HWAccel)
+	}
+	return nil
+}
+
+// videoEncodeArgs returns the video encoder flags. The x264 preset only
+// applies to libx264; the hardware encoders use their own fastest
+// low-latency setting, and crf maps to their constant-quality knob where
+// one exists.
+func (a hwAccel) videoEncodeArgs(preset string, crf int, bitrate, bufsize string) []string {
+	switch a.Encoder {
+	case "h264_nvenc":
+		return []string{
+			"-c:v", "h264_nvenc",
+			"-preset", "p1",
+			"-tune", "ll",
+			"-rc", "vbr",
+			"-cq", strconv.Itoa(crf),
+			"-maxrate", bitrate,
+			"-bufsize", bufsize,
+		}
+	case "h264_vaapi":
+		return []string{
+			"-c:v", "h264_vaapi",
+			"-b:v", bitrate,
+			"-maxrate", bitrate,
+			"-bufsize", bufsize,
+		}
+	case "h264_qsv":
+		return []string{
+			"-c:v", "h264_qsv",
+			"-preset", "veryfast",
+			"-global_quality", strconv.Itoa(crf),
+			"-look_ahead", "0",
+			"-maxrate", bitrate,
+			"-bufsize", bufsize,
+		}
+	}
+	return []string{
+		"-c:v", "libx264",
+		"-preset", preset,
+		"-tune", "zerolatency",
+		"-crf", strconv.Itoa(crf),
+		"-maxrate", bitrate,
+		"-bufsize", bufsize,
+	}
+}
+
+// parseFFmpegEncoders returns the encoder names listed by `ffmpeg -encoders`
+func parseFFmpegEncoders(output string) map[string]bool {
+	encoders := make(map[string]bool)
+	listing := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// The capability legend ends with a " ------" separator line
+		if len(fields) == 1 && fields[0] == "------" {
+			listing = true
+			continue
+		}
+		if listing && len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// detectHWAccel resolves Config.HWAccel to a pipeline, falling back to
+// software encoding if this FFmpeg build lacks the encoder. A listed encoder
+// can still fail at runtime without the matching GPU and drivers.
+func (s *Server) detectHWAccel() hwAccel {
+	accel, ok := hwAccels[s.config.HWAccel]
+	if !ok || accel.Encoder == softwareEncoding.Encoder {
+		return softwareEncoding
+	}
+
+	output, err := exec.Command(s.config.ffmpegPath(), "-hide_banner", "-encoders").Output()
+	if err != nil {
+		s.logger.Printf("Warning: could not list FFmpeg encoders (%v), falling back to software encoding", err)
+		return softwareEncoding
+	}
+	if !parseFFmpegEncoders(string(output))[accel.Encoder] {
+		s.logger.Printf("Warning: hw_accel %q needs the %s encoder, which this FFmpeg build lacks; falling back to software encoding", accel.Name, accel.Encoder)
+		return softwareEncoding
+	}
+
+	s.logger.Printf("Using hardware encoder %s (hw_accel %q)", accel.Encoder, accel.Name)
+	return accel
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// markActivity records that a viewer is or was just using the service
+func (s *Server) markActivity() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleFor reports how long the service has gone without an active stream
+func (s *Server) idleFor() time.Duration {
+	if s.activeStreams.Load() > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, s.lastActivity.Load()))
+}
+
+// isIdle reports whether the configured idle shutdown duration has elapsed
+func (s *Server) isIdle() bool {
+	idle := time.Duration(s.config.IdleShutdownDuration)
+	return idle > 0 && s.idleFor() >= idle
+}
+
+// idleExemptPaths are polled by monitoring rather than viewers, so they
+// neither count as activity nor wake the service
+var idleExemptPaths = map[string]bool{
+	"/healthz": true,
+	"/metrics": true,
+}
+
+// quiesce stops every camera's publish, sprites and record FFmpeg and pauses
+// the camera health checks until resumeFromIdle. Viewer-driven transcodes
+// already stop on their own once their last viewer leaves.
+func (s *Server) quiesce() {
+	if !s.quiesced.CompareAndSwap(false, true) {
+		return
+	}
+	stopped := 0
+	for _, cameraID := range s.cameraTasks.ids() {
+		if s.stopCameraTasks(cameraID) {
+			stopped++
+		}
+	}
+	s.log.Info("No active streams, pausing background FFmpeg and camera health checks until the next request", "event", "service_idle",
+		"idle_for", s.idleFor().Round(time.Second).String(), "cameras_paused", stopped)
+}
+
+// resumeFromIdle restarts what quiesce stopped
+func (s *Server) resumeFromIdle() {
+	if !s.quiesced.CompareAndSwap(true, false) {
+		return
+	}
+	s.log.Info("Request received, resuming background FFmpeg and camera health checks", "event", "service_wake")
+	if err := s.startAllCameraTasks(); err != nil {
+		s.logger.Printf("Failed to resume publish, sprites or record: %v", err)
+	}
+}
+
+// withWakeOnRequest records activity for every viewer request and asks the
+// tunnel monitor to bring a quiesced service and tunnel back up
+func (s *Server) withWakeOnRequest(next http.Handler) http.Handler {
+	if s.config.IdleShutdownDuration <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if idleExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.markActivity()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHostConfig is a bastion the VPS is only reachable through
+type JumpHostConfig struct {
+	Host    string   `json:"host"`
+	User    string   `json:"user,omitempty"`     // Defaults to vps_user
+	Port    int      `json:"port,omitempty"`     // Defaults to 22
+	KeyPath pathList `json:"key_path,omitempty"` // Defaults to the VPS credentials
+}
+
+func (j *JumpHostConfig) port() int {
+	if j.Port > 0 {
+		return j.Port
+	}
+	return 22
+}
+
+// destination returns user@host:port for ssh -J
+func (j *JumpHostConfig) destination(defaultUser string) string {
+	user := j.User
+	if user == "" {
+		user = defaultUser
+	}
+	return user + "@" + net.JoinHostPort(j.Host, strconv.Itoa(j.port()))
+}
+
+// dialViaJumpHost connects to the bastion, opens a TCP connection from it to
+// vpsAddr and runs the VPS SSH handshake over that connection. The returned
+// client is the VPS connection, so the reverse tunnel is bound on the VPS;
+// the bastion connection is closed when it closes.
+func (s *Server) dialViaJumpHost(vpsAddr string, vpsConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	jump := s.config.JumpHost
+
+	auth := vpsConfig.Auth
+	if len(jump.KeyPath) > 0 {
+		keys, err := s.loadKeyFiles(jump.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load jump host key: %v", err)
+		}
+		auth = []ssh.AuthMethod{ssh.PublicKeys(keys...)}
+	}
+	user := jump.User
+	if user == "" {
+		user = vpsConfig.User
+	}
+
+	jumpAddr := net.JoinHostPort(jump.Host, strconv.Itoa(jump.port()))
+	s.logger.Printf("Connecting to jump host: %s", jumpAddr)
+	bastion, err := ssh.Dial("tcp", jumpAddr, &ssh.ClientConfig{
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   vpsConfig.HostKeyCallback,
+		HostKeyAlgorithms: s.knownHostKeyAlgorithms(jumpAddr),
+		Timeout:           vpsConfig.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to jump host %s: %v", jumpAddr, err)
+	}
+
+	s.logger.Printf("Connecting to SSH server %s through %s", vpsAddr, jumpAddr)
+	conn, err := bastion.Dial("tcp", vpsAddr)
+	if err != nil {
+		bastion.Close()
+		return nil, fmt.Errorf("jump host could not reach %s: %v", vpsAddr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, vpsAddr, vpsConfig)
+	if err != nil {
+		conn.Close()
+		bastion.Close()
+		return nil, fmt.Errorf("failed to connect to SSH server through jump host: %v", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+
+	go func() {
+		client.Wait()
+		bastion.Close()
+	}()
+
+	s.logger.Println("SSH connection established")
+	return client, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultKeepaliveTimeout     = 15 * time.Second
+	defaultKeepaliveMaxFailures = 1
+	defaultKeepaliveSlowLimit   = 3
+)
+
+// keepaliveTimeout returns how long a keepalive may take before it counts as failed
+func (c *Config) keepaliveTimeout() time.Duration {
+	if c.KeepaliveTimeout > 0 {
+		return time.Duration(c.KeepaliveTimeout)
+	}
+	return defaultKeepaliveTimeout
+}
+
+// keepaliveMaxFailures returns how many consecutive failed keepalives trigger a reconnect
+func (c *Config) keepaliveMaxFailures() int {
+	if c.KeepaliveMaxFailures > 0 {
+		return c.KeepaliveMaxFailures
+	}
+	return defaultKeepaliveMaxFailures
+}
+
+// keepaliveSlowLimit returns how many consecutive keepalives over
+// KeepaliveMaxRTT trigger a reconnect
+func (c *Config) keepaliveSlowLimit() int {
+	if c.KeepaliveSlowLimit > 0 {
+		return c.KeepaliveSlowLimit
+	}
+	return defaultKeepaliveSlowLimit
+}
+
+// keepaliveHealth tracks recent keepalive round trips on the current SSH connection
+type keepaliveHealth struct {
+	lastOK   time.Time
+	lastRTT  time.Duration
+	failures int
+	slow     int
+}
+
+// reset clears the counters after the tunnel has been replaced
+func (h *keepaliveHealth) reset() {
+	*h = keepaliveHealth{lastOK: time.Now()}
+}
+
+// sendKeepalive sends one keepalive and waits at most timeout for the reply.
+// A connection behind a NAT that silently dropped it may never answer, so
+// SendRequest can't be relied on to return by itself.
+func sendKeepalive(client *ssh.Client, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return time.Since(start), err
+	case <-time.After(timeout):
+		return timeout, fmt.Errorf("no reply within %v", timeout)
+	}
+}
+
+// checkKeepalive sends a keepalive and records the result, returning a
+// reason when the connection should be rebuilt
+func (s *Server) checkKeepalive(h *keepaliveHealth) (string, bool) {
+	rtt, err := sendKeepalive(s.currentTunnel().client, s.config.keepaliveTimeout())
+	if err != nil {
+		h.failures++
+		if h.failures < s.config.keepaliveMaxFailures() {
+			s.logger.Printf("SSH keepalive failed (%d/%d): %v", h.failures, s.config.keepaliveMaxFailures(), err)
+			return "", false
+		}
+		return fmt.Sprintf("%d consecutive keepalives failed, last: %v", h.failures, err), true
+	}
+
+	h.failures = 0
+	h.lastOK = time.Now()
+	h.lastRTT = rtt
+	s.lastKeepalive.Store(h.lastOK.UnixNano())
+
+	maxRTT := time.Duration(s.config.KeepaliveMaxRTT)
+	if maxRTT <= 0 || rtt <= maxRTT {
+		h.slow = 0
+		return "", false
+	}
+	h.slow++
+	if h.slow < s.config.keepaliveSlowLimit() {
+		s.logger.Printf("SSH keepalive took %v, over the %v limit (%d/%d)", rtt.Round(time.Millisecond), maxRTT, h.slow, s.config.keepaliveSlowLimit())
+		return "", false
+	}
+	return fmt.Sprintf("%d consecutive keepalives over %v, last took %v", h.slow, maxRTT, rtt.Round(time.Millisecond)), true
+}
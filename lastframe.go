@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// openLastFrameDir creates the temp directory that holds each camera's most recent frame
+func (s *Server) openLastFrameDir() {
+	dir, err := os.MkdirTemp("", "camera-tunnel-frames-")
+	if err != nil {
+		s.logger.Printf("Warning: could not create last-frame directory, snapshots disabled: %v", err)
+		return
+	}
+	s.lastFrameDir = dir
+}
+
+// lastFramePath returns where the stream for cameraID writes its latest frame
+func (s *Server) lastFramePath(cameraID string) string {
+	return filepath.Join(s.lastFrameDir, cameraID+".jpg")
+}
+
+// lastFrameArgs returns an extra FFmpeg output that refreshes the camera's
+// last-frame JPEG once per second from the same RTSP input as the stream
+func (s *Server) lastFrameArgs(cameraID string, camera Camera) []string {
+	if !camera.LastFrame || s.lastFrameDir == "" {
+		return nil
+	}
+	return []string{
+		"-an",
+		"-vf", camera.withVideoFilters("fps=1"),
+		"-q:v", "5",
+		"-update", "1",
+		"-atomic_writing", "1",
+		"-f", "image2",
+		s.lastFramePath(cameraID),
+	}
+}
+
+func (s *Server) handleLastFrame(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(r.URL.Path, "/lastframe/")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+	if !camera.LastFrame || s.lastFrameDir == "" {
+		http.Error(w, fmt.Sprintf("Last frame capture is not enabled for camera '%s'", cameraID), http.StatusNotFound)
+		return
+	}
+
+	data, err := os.ReadFile(s.lastFramePath(cameraID))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("No frame captured yet for camera '%s'", cameraID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
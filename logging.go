@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newLoggers returns the server's printf-style logger and the structured
+// logger used for stream, tunnel and monitor events. With format "json" both
+// write JSON lines to stdout; otherwise both write the usual prefixed text.
+// Structured events below level are dropped.
+func newLoggers(format string, level slog.Level) (*log.Logger, *slog.Logger) {
+	if format == "json" {
+		handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}).WithAttrs([]slog.Attr{slog.String("component", "camera-server")})
+		return slog.NewLogLogger(handler, slog.LevelInfo), slog.New(handler)
+	}
+
+	logger := log.New(os.Stdout, "[CAMERA-SERVER] ", log.LstdFlags)
+	return logger, slog.New(&textHandler{logger: logger, level: level})
+}
+
+// validateLogFormat checks the LogFormat and LogLevel settings
+func (c *Config) validateLogFormat() error {
+	switch c.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("log_format must be \"text\" or \"json\", got %q", c.LogFormat)
+	}
+	switch c.LogLevel {
+	case "", "info", "debug":
+		return nil
+	}
+	return fmt.Errorf("log_level must be \"info\" or \"debug\", got %q", c.LogLevel)
+}
+
+// logLevel returns the minimum level of structured events to log
+func (c *Config) logLevel() slog.Level {
+	if c.LogLevel == "debug" {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// textHandler renders structured records in the text log format: the
+// message followed by key=value pairs, with warnings and errors marked
+type textHandler struct {
+	logger *log.Logger
+	level  slog.Level
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, record slog.Record) error {
+	var b strings.Builder
+	if record.Level >= slog.LevelWarn {
+		b.WriteString(record.Level.String())
+		b.WriteString(": ")
+	}
+	b.WriteString(record.Message)
+
+	for _, attr := range h.attrs {
+		writeTextAttr(&b, attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		if h.group != "" {
+			attr.Key = h.group + "." + attr.Key
+		}
+		writeTextAttr(&b, attr)
+		return true
+	})
+
+	h.logger.Print(b.String())
+	return nil
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, attr := range attrs {
+		if h.group != "" {
+			attr.Key = h.group + "." + attr.Key
+		}
+		clone.attrs = append(clone.attrs, attr)
+	}
+	return &clone
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	if h.group != "" {
+		name = h.group + "." + name
+	}
+	clone.group = name
+	return &clone
+}
+
+func writeTextAttr(b *strings.Builder, attr slog.Attr) {
+	value := attr.Value.Resolve().String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(" ")
+	b.WriteString(attr.Key)
+	b.WriteString("=")
+	b.WriteString(value)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ffmpegKey labels FFmpeg lifecycle counters
+type ffmpegKey struct {
+	camera   string
+	pipeline string // "stream", "hls", "webrtc", "publish" or "record"
+}
+
+// metrics holds the counters served by /metrics. Per-camera values live in
+// maps under mu; process-wide values are atomics.
+type metrics struct {
+	mu             sync.Mutex
+	activeStreams  map[string]int64
+	bytesStreamed  map[string]int64
+	ffmpegStarts   map[ffmpegKey]int64
+	ffmpegFailures map[ffmpegKey]int64
+
+	sshReconnects        atomic.Int64
+	sshReconnectFailures atomic.Int64
+	rateLimited          atomic.Int64
+}
+
+func (m *metrics) streamStarted(cameraID string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.activeStreams == nil {
+		m.activeStreams = make(map[string]int64)
+	}
+	m.activeStreams[cameraID] += delta
+}
+
+func (m *metrics) addBytes(cameraID string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bytesStreamed == nil {
+		m.bytesStreamed = make(map[string]int64)
+	}
+	m.bytesStreamed[cameraID] += int64(n)
+}
+
+func (m *metrics) ffmpegStarted(cameraID, pipeline string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ffmpegStarts == nil {
+		m.ffmpegStarts = make(map[ffmpegKey]int64)
+	}
+	m.ffmpegStarts[ffmpegKey{cameraID, pipeline}]++
+}
+
+// ffmpegFailed counts a process that failed to start or exited on its own
+// with an error; deliberate stops are not failures
+func (m *metrics) ffmpegFailed(cameraID, pipeline string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ffmpegFailures == nil {
+		m.ffmpegFailures = make(map[ffmpegKey]int64)
+	}
+	m.ffmpegFailures[ffmpegKey{cameraID, pipeline}]++
+}
+
+// countingWriter adds every byte written to a camera's streamed total
+type countingWriter struct {
+	w        io.Writer
+	metrics  *metrics
+	cameraID string
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.metrics.addBytes(cw.cameraID, n)
+	return n, err
+}
+
+// Metric descriptions served by /metrics
+var (
+	activeStreamsDesc = prometheus.NewDesc("camera_tunnel_active_streams",
+		"Viewers currently connected to /stream/.", []string{"camera"}, nil)
+	streamBytesDesc = prometheus.NewDesc("camera_tunnel_stream_bytes_total",
+		"Bytes of video written to /stream/ viewers.", []string{"camera"}, nil)
+	ffmpegStartsDesc = prometheus.NewDesc("camera_tunnel_ffmpeg_starts_total",
+		"FFmpeg processes started.", []string{"camera", "pipeline"}, nil)
+	ffmpegFailuresDesc = prometheus.NewDesc("camera_tunnel_ffmpeg_failures_total",
+		"FFmpeg processes that failed to start or exited with an error.", []string{"camera", "pipeline"}, nil)
+	sshReconnectsDesc = prometheus.NewDesc("camera_tunnel_ssh_reconnects_total",
+		"Successful SSH tunnel reconnects.", nil, nil)
+	sshReconnectFailuresDesc = prometheus.NewDesc("camera_tunnel_ssh_reconnect_failures_total",
+		"Failed SSH tunnel reconnect attempts.", nil, nil)
+	tunnelUpDesc = prometheus.NewDesc("camera_tunnel_tunnel_up",
+		"Whether the reverse tunnel is connected.", nil, nil)
+	slowClientsDesc = prometheus.NewDesc("camera_tunnel_slow_clients_dropped_total",
+		"Viewers disconnected for falling behind.", nil, nil)
+	acceptErrorsDesc = prometheus.NewDesc("camera_tunnel_accept_errors_total",
+		"Errors accepting tunnel connections.", nil, nil)
+	rateLimitedDesc = prometheus.NewDesc("camera_tunnel_rate_limited_total",
+		"Requests rejected with 429 by the per-client rate limit.", nil, nil)
+	hlsDiskBytesDesc = prometheus.NewDesc("camera_tunnel_hls_disk_bytes",
+		"Disk used by the segments of running HLS transcodes.", []string{"camera"}, nil)
+)
+
+// metricsCollector exposes the server's counters to Prometheus, reading them
+// at scrape time so cameras added or removed at runtime are picked up
+type metricsCollector struct {
+	s *Server
+}
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		activeStreamsDesc, streamBytesDesc, ffmpegStartsDesc, ffmpegFailuresDesc,
+		sshReconnectsDesc, sshReconnectFailuresDesc, tunnelUpDesc,
+		slowClientsDesc, acceptErrorsDesc, rateLimitedDesc, hlsDiskBytesDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	active := make(map[string]int64)
+	bytes := make(map[string]int64)
+	hlsDisk := make(map[string]int64)
+
+	// Every configured camera gets a sample so idle cameras graph as zero
+	for cameraID := range s.cameraList() {
+		active[cameraID] = 0
+		bytes[cameraID] = 0
+		hlsDisk[cameraID] = 0
+	}
+	for cameraID, n := range s.hlsDiskUsage() {
+		hlsDisk[cameraID] = n
+	}
+
+	s.metrics.mu.Lock()
+	for cameraID, n := range s.metrics.activeStreams {
+		active[cameraID] = n
+	}
+	for cameraID, n := range s.metrics.bytesStreamed {
+		bytes[cameraID] = n
+	}
+	for key, n := range s.metrics.ffmpegStarts {
+		ch <- prometheus.MustNewConstMetric(ffmpegStartsDesc, prometheus.CounterValue, float64(n), key.camera, key.pipeline)
+	}
+	for key, n := range s.metrics.ffmpegFailures {
+		ch <- prometheus.MustNewConstMetric(ffmpegFailuresDesc, prometheus.CounterValue, float64(n), key.camera, key.pipeline)
+	}
+	s.metrics.mu.Unlock()
+
+	for cameraID, n := range active {
+		ch <- prometheus.MustNewConstMetric(activeStreamsDesc, prometheus.GaugeValue, float64(n), cameraID)
+	}
+	for cameraID, n := range bytes {
+		ch <- prometheus.MustNewConstMetric(streamBytesDesc, prometheus.CounterValue, float64(n), cameraID)
+	}
+	for cameraID, n := range hlsDisk {
+		ch <- prometheus.MustNewConstMetric(hlsDiskBytesDesc, prometheus.GaugeValue, float64(n), cameraID)
+	}
+
+	tunnelUp := 0.0
+	if s.tunnelState() == "connected" {
+		tunnelUp = 1
+	}
+	ch <- prometheus.MustNewConstMetric(sshReconnectsDesc, prometheus.CounterValue, float64(s.metrics.sshReconnects.Load()))
+	ch <- prometheus.MustNewConstMetric(sshReconnectFailuresDesc, prometheus.CounterValue, float64(s.metrics.sshReconnectFailures.Load()))
+	ch <- prometheus.MustNewConstMetric(tunnelUpDesc, prometheus.GaugeValue, tunnelUp)
+	ch <- prometheus.MustNewConstMetric(slowClientsDesc, prometheus.CounterValue, float64(s.slowClientDrops.Load()))
+	ch <- prometheus.MustNewConstMetric(acceptErrorsDesc, prometheus.CounterValue, float64(s.acceptErrors.Load()))
+	ch <- prometheus.MustNewConstMetric(rateLimitedDesc, prometheus.CounterValue, float64(s.metrics.rateLimited.Load()))
+}
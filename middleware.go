@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateHeaderName checks that name is a valid HTTP header field name (RFC 7230 token)
+func validateHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("header name is empty")
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return fmt.Errorf("invalid character %q in header name %q", r, name)
+		}
+	}
+	switch http.CanonicalHeaderKey(name) {
+	case "Content-Type", "Content-Length", "Transfer-Encoding", "Connection":
+		return fmt.Errorf("header %q is managed by the server and can't be overridden", name)
+	}
+	return nil
+}
+
+// validateResponseHeaders checks every configured response header name
+func (c *Config) validateResponseHeaders() error {
+	var problems []string
+	for name := range c.ResponseHeaders {
+		if err := validateHeaderName(name); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid response_headers: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// withResponseHeaders sets the configured response headers on every response.
+// Handlers run afterwards, so the content types they set always win.
+func (s *Server) withResponseHeaders(next http.Handler) http.Handler {
+	if len(s.config.ResponseHeaders) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range s.config.ResponseHeaders {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseRecorder captures the status code and body size written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// statusCode returns the status sent, which is 200 if the handler never wrote
+func (rr *responseRecorder) statusCode() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+	return rr.status
+}
+
+// Flush keeps streaming handlers working through the recorder
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// openAccessLog opens the configured access log destination ("-" for stdout)
+func (s *Server) openAccessLog() error {
+	switch s.config.AccessLogPath {
+	case "":
+		return nil
+	case "-":
+		s.accessLog = log.New(os.Stdout, "", 0)
+		return nil
+	}
+
+	file, err := os.OpenFile(s.expandPath(s.config.AccessLogPath), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	s.accessLogFile = file
+	s.accessLog = log.New(file, "", 0)
+	return nil
+}
+
+// withAccessLog writes one Apache Combined Log Format line per request, with
+// the request time in seconds appended. Streams are logged when they end, so
+// the byte count and duration cover the whole stream.
+func (s *Server) withAccessLog(next http.Handler) http.Handler {
+	if s.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+
+		s.accessLog.Printf("%s - - [%s] %q %d %s %q %q %.3f",
+			s.clientIP(r),
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+			rec.statusCode(),
+			size,
+			r.Referer(),
+			r.UserAgent(),
+			time.Since(start).Seconds(),
+		)
+	})
+}
+
+// streamingPrefixes are the routes whose responses stay open while a viewer watches
+var streamingPrefixes = []string{"/stream/", "/mjpeg/", "/ws/"}
+
+// isStreamingPath reports whether path is served as a long-lived stream
+func isStreamingPath(path string) bool {
+	return hasAnyPrefix(path, streamingPrefixes)
+}
+
+// hasAnyPrefix reports whether path starts with one of prefixes
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRequestLog logs every request as an http_request event on the server
+// log, so it follows log_format. Streams are logged when they end, and also
+// as http_stream_open when they start, since viewers may watch for hours.
+func (s *Server) withRequestLog(next http.Handler) http.Handler {
+	if !s.config.RequestLog {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ip := s.clientIP(r)
+		streaming := isStreamingPath(r.URL.Path)
+		if streaming {
+			s.log.Info("Stream opened", "event", "http_stream_open", "method", r.Method, "path", r.URL.Path, "remote_addr", ip)
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		s.log.Info("Request served", "event", "http_request", "method", r.Method, "path", r.URL.Path, "status", rec.statusCode(),
+			"bytes", rec.bytes, "remote_addr", ip, "duration", time.Since(start).Round(time.Millisecond).String(), "streaming", streaming)
+	})
+}
+
+// clientIP returns the host part of the request's remote address. Requests
+// through the tunnel report the client address the VPS saw.
+func (s *Server) clientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if viaTunnel(r) {
+		if peer, ok := s.tunnelPeers.Load(r.RemoteAddr); ok {
+			addr = peer.(string)
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultMJPEGFPS = 10
+	mjpegBoundary   = "cameraframe"
+)
+
+// mjpegFPS returns the frame rate of /mjpeg/ streams
+func (c *Config) mjpegFPS() int {
+	if c.MJPEGFPS > 0 {
+		return c.MJPEGFPS
+	}
+	return defaultMJPEGFPS
+}
+
+// buildMJPEGArgs returns FFmpeg args that re-encode the camera as a
+// multipart JPEG stream, one part per frame
+func buildMJPEGArgs(camera Camera, rtspURL string, fps int) []string {
+	buffering, _ := camera.bufferingOptions()
+
+	args := camera.rtspInputArgs()
+	args = append(args, buffering.inputArgs()...)
+	args = append(args, camera.probeArgs()...)
+	return append(args,
+		"-i", rtspURL,
+		"-vf", camera.withVideoFilters(fmt.Sprintf("fps=%d", fps)),
+		"-an",
+		"-c:v", "mjpeg",
+		"-q:v", "5",
+		"-f", "mpjpeg",
+		"-boundary_tag", mjpegBoundary,
+		"pipe:1",
+	)
+}
+
+// handleCameraMJPEG serves /mjpeg/{id} as multipart/x-mixed-replace, which
+// browsers render live in a plain <img> tag
+func (s *Server) handleCameraMJPEG(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(r.URL.Path, "/mjpeg/")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+
+	s.logger.Printf("Starting MJPEG stream for %s (%s)", camera.Name, cameraID)
+
+	// FFmpeg stops as soon as the client goes away or the server shuts down
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+
+	cmd := s.ffmpegCommand(ctx, buildMJPEGArgs(s.withCameraDefaults(camera), s.selectRTSPURL(camera), s.config.mjpegFPS())...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, "Failed to create FFmpeg pipe", http.StatusInternalServerError)
+		return
+	}
+	if err := s.startFFmpeg(cmd); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to start FFmpeg: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		stopFFmpeg(cmd)
+		cmd.Wait()
+	}()
+
+	unregister := s.work.add(fmt.Sprintf("%s mjpeg for %s", cameraID, r.RemoteAddr), closerFunc(func() error {
+		return cmd.Process.Kill()
+	}))
+	defer unregister()
+
+	s.activeStreams.Add(1)
+	defer func() {
+		s.activeStreams.Add(-1)
+		s.markActivity()
+	}()
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Connection", "close")
+
+	// Each frame is its own part, so always flush or the browser shows nothing
+	var dst io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok {
+		dst = &flushWriter{w: w, flusher: flusher}
+	}
+	err = s.copyBuffered(w, dst, stdout)
+	if err == errSlowClient {
+		s.logger.Printf("Dropped slow client from %s MJPEG stream: buffer of %d bytes full (%d slow clients dropped so far)",
+			camera.Name, s.config.clientBufferSize(), s.slowClientDrops.Load())
+	} else if err != nil {
+		s.logger.Printf("Client disconnected from %s MJPEG stream: %v", camera.Name, err)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// multiFrameQueue is how many frames may wait for one socket. A socket
+	// that falls behind skips frames instead of being disconnected, since
+	// every MJPEG frame stands on its own.
+	multiFrameQueue = 32
+	// multiWriteTimeout closes a socket whose client stopped reading
+	multiWriteTimeout = 10 * time.Second
+	// maxMultiMessage bounds the control messages a client may send
+	maxMultiMessage = 4096
+	// maxMultiFrame guards against a corrupt part allocating unbounded memory
+	maxMultiFrame = 16 * 1024 * 1024
+)
+
+// multiRequest is a control message from a /ws/multi client:
+// {"action": "subscribe", "cameras": ["front", "back"]} or "unsubscribe"
+type multiRequest struct {
+	Action  string   `json:"action"`
+	Cameras []string `json:"cameras"`
+}
+
+// multiReply is a control message to a /ws/multi client. Type is
+// "subscribed", "unsubscribed", "ended" when the camera's stream stopped,
+// or "error".
+type multiReply struct {
+	Type   string `json:"type"`
+	Camera string `json:"camera,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// multiSocket is one /ws/multi connection. Frames and replies are queued
+// for its writer goroutine, so a slow client never blocks a camera's
+// FFmpeg or the socket's own reads.
+type multiSocket struct {
+	frames  chan []byte
+	replies chan multiReply
+	done    chan struct{}
+
+	mu      sync.Mutex
+	sources map[string]*frameSource // Subscribed cameras, guarded by mu
+}
+
+// reply queues a control message, giving up if the socket has closed
+func (m *multiSocket) reply(msg multiReply) {
+	select {
+	case m.replies <- msg:
+	case <-m.done:
+	}
+}
+
+// frameSource runs one MJPEG transcode for a camera and hands every frame,
+// tagged with the camera ID, to the sockets subscribed to it
+type frameSource struct {
+	cameraID string
+	cmd      *exec.Cmd
+
+	mu        sync.Mutex
+	sockets   map[*multiSocket]struct{}
+	idleTimer *time.Timer
+	stopped   bool
+}
+
+// frameSources holds the running frame source per camera
+type frameSources struct {
+	mu      sync.Mutex
+	sources map[string]*frameSource
+}
+
+// runningFrameSource returns the source sockets of cameraID can join.
+// Callers hold s.frames.mu.
+func (s *Server) runningFrameSource(cameraID string) (*frameSource, bool) {
+	source, ok := s.frames.sources[cameraID]
+	if !ok || source.isStopped() {
+		return nil, false
+	}
+	return source, true
+}
+
+// joinableFrameSource returns the frame source for cameraID, starting it if
+// none is running. As with shared streams, the RTSP URL is picked without
+// holding s.frames.mu.
+func (s *Server) joinableFrameSource(cameraID string, camera Camera) (*frameSource, error) {
+	s.frames.mu.Lock()
+	source, ok := s.runningFrameSource(cameraID)
+	s.frames.mu.Unlock()
+	if ok {
+		return source, nil
+	}
+
+	args := buildMJPEGArgs(s.withCameraDefaults(camera), s.selectRTSPURL(camera), s.config.mjpegFPS())
+
+	s.frames.mu.Lock()
+	defer s.frames.mu.Unlock()
+	// Another socket may have started it in the meantime
+	if source, ok := s.runningFrameSource(cameraID); ok {
+		return source, nil
+	}
+	source, err := s.startFrameSource(cameraID, camera, args)
+	if err != nil {
+		return nil, err
+	}
+	if s.frames.sources == nil {
+		s.frames.sources = make(map[string]*frameSource)
+	}
+	s.frames.sources[cameraID] = source
+	return source, nil
+}
+
+// startFrameSource starts FFmpeg with args and the goroutine that splits
+// its multipart output into frames
+func (s *Server) startFrameSource(cameraID string, camera Camera, args []string) (*frameSource, error) {
+	cmd := s.ffmpegCommand(s.ctx, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create FFmpeg pipe: %v", err)
+	}
+	if err := s.startFFmpeg(cmd); err != nil {
+		return nil, fmt.Errorf("failed to start FFmpeg: %v", err)
+	}
+	s.logger.Printf("Started multiplexed MJPEG for %s (%s)", camera.Name, cameraID)
+
+	source := &frameSource{cameraID: cameraID, cmd: cmd, sockets: make(map[*multiSocket]struct{})}
+	unregister := s.work.add(fmt.Sprintf("%s multiplexed mjpeg", cameraID), closerFunc(func() error {
+		return cmd.Process.Kill()
+	}))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer unregister()
+
+		err := source.pump(stdout)
+		stopFFmpeg(cmd)
+		cmd.Wait()
+		if err != nil && s.ctx.Err() == nil {
+			s.logger.Printf("Multiplexed MJPEG for %s ended: %v", camera.Name, err)
+		}
+
+		s.frames.mu.Lock()
+		if s.frames.sources[cameraID] == source {
+			delete(s.frames.sources, cameraID)
+		}
+		s.frames.mu.Unlock()
+		source.stop()
+	}()
+
+	return source, nil
+}
+
+// pump reads JPEG frames from FFmpeg's mpjpeg output and broadcasts each
+// one, until the pipe closes
+func (f *frameSource) pump(r io.Reader) error {
+	parts := multipart.NewReader(r, mjpegBoundary)
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		jpeg, err := io.ReadAll(io.LimitReader(part, maxMultiFrame+1))
+		if err != nil {
+			return err
+		}
+		if len(jpeg) > maxMultiFrame {
+			return fmt.Errorf("frame larger than %d bytes", maxMultiFrame)
+		}
+		f.broadcast(tagFrame(f.cameraID, jpeg))
+	}
+}
+
+// tagFrame prefixes a frame with its camera ID: one byte of ID length, the
+// ID, then the JPEG
+func tagFrame(cameraID string, jpeg []byte) []byte {
+	frame := make([]byte, 0, 1+len(cameraID)+len(jpeg))
+	frame = append(frame, byte(len(cameraID)))
+	frame = append(frame, cameraID...)
+	return append(frame, jpeg...)
+}
+
+// broadcast queues frame for every socket, skipping sockets whose queue is full
+func (f *frameSource) broadcast(frame []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for socket := range f.sockets {
+		select {
+		case socket.frames <- frame:
+		default:
+		}
+	}
+}
+
+// add attaches socket, returning false if the source has already stopped
+func (f *frameSource) add(socket *multiSocket) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stopped {
+		return false
+	}
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+		f.idleTimer = nil
+	}
+	f.sockets[socket] = struct{}{}
+	return true
+}
+
+// removeFrameSocket detaches socket, stopping FFmpeg after the grace period if it was the last
+func (s *Server) removeFrameSocket(f *frameSource, socket *multiSocket) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.sockets[socket]; !ok {
+		return
+	}
+	delete(f.sockets, socket)
+
+	if len(f.sockets) == 0 && !f.stopped {
+		f.idleTimer = time.AfterFunc(s.config.streamGracePeriod(), func() {
+			f.mu.Lock()
+			idle := len(f.sockets) == 0
+			if idle {
+				f.stopped = true
+			}
+			f.mu.Unlock()
+			if idle {
+				s.logger.Printf("No subscribers left for %s, stopping multiplexed MJPEG", f.cameraID)
+				stopFFmpeg(f.cmd)
+			}
+		})
+	}
+}
+
+func (f *frameSource) isStopped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stopped
+}
+
+// stop tells every subscribed socket the camera's stream ended once FFmpeg has exited
+func (f *frameSource) stop() {
+	f.mu.Lock()
+	f.stopped = true
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+	}
+	sockets := make([]*multiSocket, 0, len(f.sockets))
+	for socket := range f.sockets {
+		delete(f.sockets, socket)
+		sockets = append(sockets, socket)
+	}
+	f.mu.Unlock()
+
+	for _, socket := range sockets {
+		socket.mu.Lock()
+		if socket.sources[f.cameraID] == f {
+			delete(socket.sources, f.cameraID)
+		}
+		socket.mu.Unlock()
+		// Not waited for: one slow socket mustn't hold up the others
+		select {
+		case socket.replies <- multiReply{Type: "ended", Camera: f.cameraID}:
+		default:
+		}
+	}
+}
+
+// hijackableWriter lets the WebSocket server hijack the connection through
+// the middleware's response wrappers, which only expose Unwrap
+type hijackableWriter struct {
+	http.ResponseWriter
+}
+
+func (w hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// handleMultiStream serves /ws/multi, a WebSocket carrying the MJPEG frames
+// of every camera the client subscribes to
+func (s *Server) handleMultiStream(w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{
+		Handshake: checkWebSocketOrigin,
+		Handler:   s.serveMultiSocket,
+	}
+	server.ServeHTTP(hijackableWriter{w}, r)
+}
+
+// checkWebSocketOrigin refuses browser connections from other sites, which
+// would otherwise ride on the viewer's saved credentials. Apps that send
+// no Origin are allowed.
+func checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("cross-origin WebSocket from %q refused", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+func (s *Server) serveMultiSocket(ws *websocket.Conn) {
+	r := ws.Request()
+	ws.MaxPayloadBytes = maxMultiMessage
+
+	socket := &multiSocket{
+		frames:  make(chan []byte, multiFrameQueue),
+		replies: make(chan multiReply, 16),
+		done:    make(chan struct{}),
+		sources: make(map[string]*frameSource),
+	}
+	s.log.Info("Multiplexed stream opened", "event", "multi_open", "remote_addr", r.RemoteAddr)
+
+	unregister := s.work.add("multiplexed stream for "+r.RemoteAddr, ws)
+	defer unregister()
+
+	s.activeStreams.Add(1)
+	defer func() {
+		s.activeStreams.Add(-1)
+		s.markActivity()
+	}()
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.writeMultiSocket(ws, socket)
+	}()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			break
+		}
+		var req multiRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			socket.reply(multiReply{Type: "error", Error: fmt.Sprintf("invalid message: %v", err)})
+			continue
+		}
+		switch req.Action {
+		case "subscribe":
+			for _, cameraID := range req.Cameras {
+				socket.reply(s.subscribeFrames(r, socket, cameraID))
+			}
+		case "unsubscribe":
+			for _, cameraID := range req.Cameras {
+				socket.reply(s.unsubscribeFrames(socket, cameraID))
+			}
+		default:
+			socket.reply(multiReply{Type: "error", Error: fmt.Sprintf("unknown action %q, expected subscribe or unsubscribe", req.Action)})
+		}
+	}
+
+	// The socket closed: release its cameras and stop the writer
+	close(socket.done)
+	ws.Close()
+	<-written
+	socket.mu.Lock()
+	sources := socket.sources
+	socket.sources = nil
+	socket.mu.Unlock()
+	for _, source := range sources {
+		s.removeFrameSocket(source, socket)
+	}
+	s.log.Info("Multiplexed stream closed", "event", "multi_close", "remote_addr", r.RemoteAddr, "cameras", len(sources))
+}
+
+// writeMultiSocket sends queued frames as binary messages and replies as
+// JSON text messages until the socket is done or a write fails
+func (s *Server) writeMultiSocket(ws *websocket.Conn, socket *multiSocket) {
+	for {
+		var err error
+		select {
+		case <-socket.done:
+			return
+		case frame := <-socket.frames:
+			ws.SetWriteDeadline(time.Now().Add(multiWriteTimeout))
+			err = websocket.Message.Send(ws, frame)
+		case msg := <-socket.replies:
+			ws.SetWriteDeadline(time.Now().Add(multiWriteTimeout))
+			err = websocket.JSON.Send(ws, msg)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Closing makes the read loop return and clean up; until then its
+	// replies are discarded so it never blocks on a dead writer
+	ws.Close()
+	for {
+		select {
+		case <-socket.done:
+			return
+		case <-socket.frames:
+		case <-socket.replies:
+		}
+	}
+}
+
+// subscribeFrames adds cameraID to the socket, starting its frame source
+// if needed
+func (s *Server) subscribeFrames(r *http.Request, socket *multiSocket, cameraID string) multiReply {
+	camera, exists := s.camera(cameraID)
+	switch {
+	case !exists:
+		return multiReply{Type: "error", Camera: cameraID, Error: "camera not found"}
+	case !cameraVisible(r, camera):
+		return multiReply{Type: "error", Camera: cameraID, Error: "camera is only available on the local network"}
+	case !s.cameraAllowed(r, camera):
+		return multiReply{Type: "error", Camera: cameraID, Error: "not allowed to view this camera"}
+	case len(cameraID) > 255:
+		return multiReply{Type: "error", Camera: cameraID, Error: "camera ID is too long to tag frames with"}
+	}
+
+	socket.mu.Lock()
+	_, subscribed := socket.sources[cameraID]
+	socket.mu.Unlock()
+	if subscribed {
+		return multiReply{Type: "subscribed", Camera: cameraID}
+	}
+
+	// The source found may stop before the socket is attached, in which
+	// case the next one is started
+	for attempt := 1; ; attempt++ {
+		source, err := s.joinableFrameSource(cameraID, camera)
+		if err != nil {
+			s.logger.Printf("Failed to start multiplexed MJPEG for %s: %v", camera.Name, err)
+			return multiReply{Type: "error", Camera: cameraID, Error: "failed to start stream"}
+		}
+		socket.mu.Lock()
+		socket.sources[cameraID] = source
+		socket.mu.Unlock()
+		if source.add(socket) {
+			return multiReply{Type: "subscribed", Camera: cameraID}
+		}
+		socket.mu.Lock()
+		delete(socket.sources, cameraID)
+		socket.mu.Unlock()
+		if attempt == 3 {
+			return multiReply{Type: "error", Camera: cameraID, Error: "stream ended before it could be joined"}
+		}
+	}
+}
+
+// unsubscribeFrames removes cameraID from the socket
+func (s *Server) unsubscribeFrames(socket *multiSocket, cameraID string) multiReply {
+	socket.mu.Lock()
+	source, ok := socket.sources[cameraID]
+	delete(socket.sources, cameraID)
+	socket.mu.Unlock()
+	if ok {
+		s.removeFrameSocket(source, socket)
+	}
+	return multiReply{Type: "unsubscribed", Camera: cameraID}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestMultiStream subscribes one socket to two cameras, checks it receives
+// tagged frames from both, and that their FFmpeg processes stop once the
+// socket has unsubscribed and closed
+func TestMultiStream(t *testing.T) {
+	// Stand-in for FFmpeg writing mpjpeg parts until it is stopped
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nwhile true; do printf -- '--" + mjpegBoundary + "\\r\\nContent-Type: image/jpeg\\r\\nContent-Length: 4\\r\\n\\r\\nJPEG\\r\\n' || exit 0; sleep 0.05; done\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(&Config{
+		FFmpegPath:        ffmpeg,
+		StreamGracePeriod: Duration(50 * time.Millisecond),
+		Cameras: map[string]Camera{
+			"front": {Name: "Front", RTSPURL: "rtsp://127.0.0.1:1/front"},
+			"back":  {Name: "Back", RTSPURL: "rtsp://127.0.0.1:1/back"},
+		},
+	})
+	s.logger.SetOutput(&syncBuffer{})
+	s.ffmpegInfo = &ffmpegInfo{Version: "test"}
+	defer s.Stop()
+
+	server := httptest.NewServer(s.setupRoutes())
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/multi", "", server.URL)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(10 * time.Second))
+
+	send := func(req multiRequest) {
+		t.Helper()
+		if err := websocket.JSON.Send(ws, req); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	// receive reads until every camera in want has both a reply of the
+	// given type and, when frames is set, a frame
+	receive := func(replyType string, frames bool, want ...string) {
+		t.Helper()
+		replied := make(map[string]bool)
+		framed := make(map[string]bool)
+		for done := false; !done; {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if data[0] == '{' {
+				var reply multiReply
+				if err := json.Unmarshal(data, &reply); err != nil {
+					t.Fatalf("invalid reply %q: %v", data, err)
+				}
+				if reply.Type == "error" {
+					t.Fatalf("error reply: %+v", reply)
+				}
+				if reply.Type == replyType {
+					replied[reply.Camera] = true
+				}
+			} else {
+				n := int(data[0])
+				if cameraID, jpeg := string(data[1:1+n]), string(data[1+n:]); jpeg == "JPEG" {
+					framed[cameraID] = true
+				} else {
+					t.Fatalf("frame for %q has payload %q", cameraID, jpeg)
+				}
+			}
+
+			done = true
+			for _, cameraID := range want {
+				if !replied[cameraID] || (frames && !framed[cameraID]) {
+					done = false
+				}
+			}
+		}
+	}
+
+	send(multiRequest{Action: "subscribe", Cameras: []string{"front", "back"}})
+	receive("subscribed", true, "front", "back")
+
+	send(multiRequest{Action: "unsubscribe", Cameras: []string{"back"}})
+	receive("unsubscribed", false, "back")
+	waitFor(t, func() bool {
+		s.frames.mu.Lock()
+		defer s.frames.mu.Unlock()
+		_, running := s.frames.sources["back"]
+		return !running
+	})
+
+	send(multiRequest{Action: "subscribe", Cameras: []string{"missing"}})
+	var reply multiReply
+	for reply.Camera != "missing" {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		json.Unmarshal(data, &reply)
+	}
+	if reply.Type != "error" {
+		t.Errorf("subscribing to an unknown camera replied %+v", reply)
+	}
+
+	ws.Close()
+	waitFor(t, func() bool {
+		s.frames.mu.Lock()
+		defer s.frames.mu.Unlock()
+		return len(s.frames.sources) == 0
+	})
+	waitFor(t, func() bool { return len(s.ffmpegProcs.running()) == 0 })
+}
+
+func TestMultiStreamRefusesOtherOrigins(t *testing.T) {
+	s := NewServer(&Config{})
+	s.logger.SetOutput(&syncBuffer{})
+	s.ffmpegInfo = &ffmpegInfo{Version: "test"}
+	defer s.Stop()
+
+	server := httptest.NewServer(s.setupRoutes())
+	defer server.Close()
+
+	if ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/multi", "", "http://evil.example.com"); err == nil {
+		ws.Close()
+		t.Error("a cross-origin socket was accepted")
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// wsDiscoveryAddr is the WS-Discovery multicast group and port
+const wsDiscoveryAddr = "239.255.255.250:3702"
+
+const wsDiscoveryProbe = `<?xml version="1.0" encoding="UTF-8"?>
+<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<e:Header><w:MessageID>uuid:%s</w:MessageID><w:To e:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</w:To><w:Action e:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</w:Action></e:Header>
+<e:Body><d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe></e:Body>
+</e:Envelope>`
+
+// onvifDevice is one camera that answered a discovery probe
+type onvifDevice struct {
+	Address string // Endpoint reference, stable per device
+	XAddrs  []string
+	Scopes  []string
+}
+
+// scope returns the value of an onvif://www.onvif.org/<kind>/ scope, if present
+func (d onvifDevice) scope(kind string) string {
+	prefix := "onvif://www.onvif.org/" + kind + "/"
+	for _, scope := range d.Scopes {
+		if strings.HasPrefix(scope, prefix) {
+			value, err := url.PathUnescape(strings.TrimPrefix(scope, prefix))
+			if err != nil {
+				return strings.TrimPrefix(scope, prefix)
+			}
+			return value
+		}
+	}
+	return ""
+}
+
+type probeMatches struct {
+	Matches []struct {
+		Address string `xml:"EndpointReference>Address"`
+		Scopes  string `xml:"Scopes"`
+		XAddrs  string `xml:"XAddrs"`
+	} `xml:"Body>ProbeMatches>ProbeMatch"`
+}
+
+// discoveryInterfaces returns the IPv4 address of every up, multicast-capable,
+// non-loopback interface
+func discoveryInterfaces() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+			}
+		}
+	}
+	return ips, nil
+}
+
+// discoverONVIF sends a WS-Discovery probe from every interface and collects
+// the devices that answer within timeout, logging progress to logger. Each
+// socket is bound to its interface's address so the kernel sends the
+// multicast out of that interface.
+func discoverONVIF(timeout time.Duration, logger *log.Logger) ([]onvifDevice, error) {
+	ips, err := discoveryInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no multicast-capable network interfaces found")
+	}
+	group, err := net.ResolveUDPAddr("udp4", wsDiscoveryAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(chan onvifDevice)
+	done := make(chan struct{})
+	deadline := time.Now().Add(timeout)
+	listeners := 0
+
+	for _, ip := range ips {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			logger.Printf("Skipping %s: %v", ip, err)
+			continue
+		}
+		probe := fmt.Sprintf(wsDiscoveryProbe, newUUID())
+		if _, err := conn.WriteToUDP([]byte(probe), group); err != nil {
+			logger.Printf("Skipping %s: failed to send probe: %v", ip, err)
+			conn.Close()
+			continue
+		}
+		logger.Printf("Sent ONVIF probe from %s", ip)
+
+		listeners++
+		go func(conn *net.UDPConn) {
+			defer conn.Close()
+			conn.SetReadDeadline(deadline)
+			buf := make([]byte, 64*1024)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					done <- struct{}{}
+					return
+				}
+				var matches probeMatches
+				if xml.Unmarshal(buf[:n], &matches) != nil {
+					continue
+				}
+				for _, m := range matches.Matches {
+					found <- onvifDevice{
+						Address: strings.TrimSpace(m.Address),
+						XAddrs:  strings.Fields(m.XAddrs),
+						Scopes:  strings.Fields(m.Scopes),
+					}
+				}
+			}
+		}(conn)
+	}
+	if listeners == 0 {
+		return nil, fmt.Errorf("could not send a discovery probe on any interface")
+	}
+
+	// A device on several interfaces answers each probe; keep the first
+	seen := make(map[string]bool)
+	var devices []onvifDevice
+	for listeners > 0 {
+		select {
+		case device := <-found:
+			if device.Address == "" || seen[device.Address] || len(device.XAddrs) == 0 {
+				continue
+			}
+			seen[device.Address] = true
+			devices = append(devices, device)
+		case <-done:
+			listeners--
+		}
+	}
+	return devices, nil
+}
+
+// newUUID returns a random version 4 UUID for WS-Discovery message IDs
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// onvifClient calls ONVIF SOAP services, with WS-Security UsernameToken
+// authentication when a username is set
+type onvifClient struct {
+	http     *http.Client
+	username string
+	password string
+}
+
+// securityHeader returns a UsernameToken header with a password digest:
+// base64(sha1(nonce + created + password))
+func (c *onvifClient) securityHeader() string {
+	if c.username == "" {
+		return ""
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	created := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	digest := sha1.Sum(append(append(append([]byte(nil), nonce...), created...), c.password...))
+
+	var username bytes.Buffer
+	xml.EscapeText(&username, []byte(c.username))
+	return fmt.Sprintf(`<s:Header><Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">`+
+		`<UsernameToken><Username>%s</Username>`+
+		`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">%s</Password>`+
+		`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">%s</Nonce>`+
+		`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%s</Created>`+
+		`</UsernameToken></Security></s:Header>`,
+		username.String(), base64.StdEncoding.EncodeToString(digest[:]), base64.StdEncoding.EncodeToString(nonce), created)
+}
+
+// call posts a SOAP request with body inside the envelope and decodes the response into out
+func (c *onvifClient) call(endpoint, body string, out interface{}) error {
+	envelope := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">` +
+		c.securityHeader() + `<s:Body>` + body + `</s:Body></s:Envelope>`
+
+	resp, err := c.http.Post(endpoint, "application/soap+xml; charset=utf-8", strings.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Reason string `xml:"Body>Fault>Reason>Text"`
+		}
+		xml.Unmarshal(data, &fault)
+		if fault.Reason != "" {
+			return fmt.Errorf("%s: %s", resp.Status, fault.Reason)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// onvifProfile is a media profile with its RTSP stream URI
+type onvifProfile struct {
+	Name      string
+	Width     int
+	Height    int
+	StreamURI string
+}
+
+// streamProfiles asks a device for its media profiles and their RTSP URIs
+func (c *onvifClient) streamProfiles(deviceURL string) ([]onvifProfile, error) {
+	var caps struct {
+		MediaXAddr string `xml:"Body>GetCapabilitiesResponse>Capabilities>Media>XAddr"`
+	}
+	err := c.call(deviceURL, `<tds:GetCapabilities><tds:Category>Media</tds:Category></tds:GetCapabilities>`, &caps)
+	if err != nil {
+		return nil, fmt.Errorf("GetCapabilities: %v", err)
+	}
+	mediaURL := strings.TrimSpace(caps.MediaXAddr)
+	if mediaURL == "" {
+		return nil, fmt.Errorf("device has no media service")
+	}
+
+	var profiles struct {
+		Profiles []struct {
+			Token      string `xml:"token,attr"`
+			Name       string `xml:"Name"`
+			Resolution struct {
+				Width  int `xml:"Width"`
+				Height int `xml:"Height"`
+			} `xml:"VideoEncoderConfiguration>Resolution"`
+		} `xml:"Body>GetProfilesResponse>Profiles"`
+	}
+	if err := c.call(mediaURL, `<trt:GetProfiles/>`, &profiles); err != nil {
+		return nil, fmt.Errorf("GetProfiles: %v", err)
+	}
+
+	var result []onvifProfile
+	for _, p := range profiles.Profiles {
+		var token bytes.Buffer
+		xml.EscapeText(&token, []byte(p.Token))
+		var uri struct {
+			URI string `xml:"Body>GetStreamUriResponse>MediaUri>Uri"`
+		}
+		body := `<trt:GetStreamUri><trt:StreamSetup><tt:Stream>RTP-Unicast</tt:Stream>` +
+			`<tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport></trt:StreamSetup>` +
+			`<trt:ProfileToken>` + token.String() + `</trt:ProfileToken></trt:GetStreamUri>`
+		if err := c.call(mediaURL, body, &uri); err != nil {
+			return nil, fmt.Errorf("GetStreamUri for profile %s: %v", p.Name, err)
+		}
+		result = append(result, onvifProfile{
+			Name:      p.Name,
+			Width:     p.Resolution.Width,
+			Height:    p.Resolution.Height,
+			StreamURI: strings.TrimSpace(uri.URI),
+		})
+	}
+	return result, nil
+}
+
+var nonIDChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// discoveredCameraID derives a config key from the device name, falling
+// back to the host, and numbers it if already taken
+func discoveredCameraID(name, host string, taken map[string]Camera) string {
+	id := strings.Trim(nonIDChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if id == "" {
+		id = strings.Trim(nonIDChars.ReplaceAllString(host, "-"), "-")
+	}
+	if id == "" {
+		id = "camera"
+	}
+	candidate := id
+	for n := 2; ; n++ {
+		if _, exists := taken[candidate]; !exists {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", id, n)
+	}
+}
+
+// onvifPassword returns the camera password for -discover from ONVIF_PASSWORD,
+// prompting on stderr when a user is given without one
+func onvifPassword(username string) (string, error) {
+	if username == "" {
+		return "", nil
+	}
+	if password := os.Getenv("ONVIF_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter ONVIF password for %s: ", username)
+	password, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+	return string(password), nil
+}
+
+// runDiscovery probes the local network for ONVIF cameras and prints a
+// "cameras" block for camera_config.json to stdout. Progress goes to the log
+// on stderr, so the output can be redirected straight into a file.
+func runDiscovery(timeout time.Duration, username, password string) error {
+	log.Printf("Searching for ONVIF cameras for %v...", timeout)
+	devices, err := discoverONVIF(timeout, log.Default())
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d ONVIF device(s)", len(devices))
+
+	client := &onvifClient{
+		http:     &http.Client{Timeout: timeout + 5*time.Second},
+		username: username,
+		password: password,
+	}
+
+	// Stable output order regardless of which device answered first
+	sort.Slice(devices, func(i, j int) bool { return devices[i].XAddrs[0] < devices[j].XAddrs[0] })
+
+	cameras := make(map[string]Camera)
+	for _, device := range devices {
+		deviceURL := device.XAddrs[0]
+		host := deviceURL
+		if u, err := url.Parse(deviceURL); err == nil {
+			host = u.Hostname()
+		}
+
+		profiles, err := client.streamProfiles(deviceURL)
+		if err != nil {
+			log.Printf("Skipping %s: %v (pass -onvif-user if the camera needs a login)", host, err)
+			continue
+		}
+		if len(profiles) == 0 || profiles[0].StreamURI == "" {
+			log.Printf("Skipping %s: no RTSP stream profiles", host)
+			continue
+		}
+
+		name := device.scope("name")
+		if name == "" {
+			name = host
+		}
+		rtspURL := profiles[0].StreamURI
+		if username != "" {
+			if u, err := url.Parse(rtspURL); err == nil && u.User == nil {
+				u.User = url.UserPassword(username, password)
+				rtspURL = u.String()
+			}
+		}
+
+		// The first profile is normally the main stream; log the rest so a
+		// substream can be swapped in by hand
+		for _, p := range profiles[1:] {
+			log.Printf("%s: additional profile %q (%dx%d) at %s", host, p.Name, p.Width, p.Height, redactRTSP(p.StreamURI))
+		}
+
+		description := fmt.Sprintf("%s at %s", strings.TrimSpace(device.scope("hardware")), host)
+		if device.scope("hardware") == "" {
+			description = "ONVIF camera at " + host
+		}
+		id := discoveredCameraID(name, host, cameras)
+		cameras[id] = Camera{
+			Name:        name,
+			RTSPURL:     rtspURL,
+			Description: description,
+			ONVIFID:     device.Address,
+		}
+		log.Printf("%s: %s (%s, %dx%d)", id, name, profiles[0].Name, profiles[0].Width, profiles[0].Height)
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{"cameras": cameras}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
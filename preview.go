@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPreviewFPS            = 8
+	defaultPreviewWidth          = 320
+	defaultPreviewDuration       = 3 * time.Second
+	defaultPreviewCacheTTL       = 30 * time.Second
+	defaultMaxConcurrentPreviews = 2
+)
+
+// previewCache holds recently generated preview GIFs
+type previewCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedPreview
+}
+
+type cachedPreview struct {
+	data    []byte
+	created time.Time
+}
+
+// get returns a cached preview for cameraID if it is younger than ttl
+func (c *previewCache) get(cameraID string, ttl time.Duration) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cameraID]
+	if !ok || time.Since(entry.created) > ttl {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+func (c *previewCache) put(cameraID string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]cachedPreview)
+	}
+	c.entries[cameraID] = cachedPreview{data: data, created: time.Now()}
+}
+
+// captureLimiter bounds how many one-off FFmpeg captures (previews, snapshots and
+// sprite stills) run at once
+type captureLimiter struct {
+	mu      sync.Mutex
+	running int
+}
+
+// acquire reserves one of max capture slots, returning false if all are busy
+func (c *captureLimiter) acquire(max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running >= max {
+		return false
+	}
+	c.running++
+	return true
+}
+
+func (c *captureLimiter) release() {
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+}
+
+// maxCaptures returns the capture slot limit
+func (c *Config) maxCaptures() int {
+	if c.MaxConcurrentPreviews > 0 {
+		return c.MaxConcurrentPreviews
+	}
+	return defaultMaxConcurrentPreviews
+}
+
+// previewSettings returns the effective fps, width, duration and cache TTL
+func (c *Config) previewSettings() (fps, width int, duration, ttl time.Duration) {
+	fps, width = defaultPreviewFPS, defaultPreviewWidth
+	duration, ttl = defaultPreviewDuration, defaultPreviewCacheTTL
+	if c.PreviewFPS > 0 {
+		fps = c.PreviewFPS
+	}
+	if c.PreviewWidth > 0 {
+		width = c.PreviewWidth
+	}
+	if c.PreviewDuration > 0 {
+		duration = time.Duration(c.PreviewDuration)
+	}
+	if c.PreviewCacheTTL > 0 {
+		ttl = time.Duration(c.PreviewCacheTTL)
+	}
+	return
+}
+
+// buildPreviewArgs returns FFmpeg args that capture a short clip and encode it
+// as a looping GIF with a generated palette, after the camera's own filters
+func buildPreviewArgs(camera Camera, rtspURL string, fps, width int, duration time.Duration) []string {
+	chain := camera.withVideoFilters(fmt.Sprintf("fps=%d,scale=%d:-1:flags=lanczos", fps, width))
+	filter := chain + ",split[s0][s1];[s0]palettegen[p];[s1][p]paletteuse"
+	args := camera.rtspInputArgs()
+	args = append(args, camera.probeArgs()...)
+	return append(args,
+		"-i", rtspURL,
+		"-t", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64),
+		"-vf", filter,
+		"-an",
+		"-loop", "0",
+		"-f", "gif",
+		"pipe:1",
+	)
+}
+
+func (s *Server) handleCameraPreview(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/preview/")
+	if !strings.HasSuffix(name, ".gif") {
+		http.NotFound(w, r)
+		return
+	}
+	cameraID := strings.TrimSuffix(name, ".gif")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+
+	fps, width, duration, ttl := s.config.previewSettings()
+
+	data, cached := s.previews.get(cameraID, ttl)
+	if !cached {
+		if !s.captures.acquire(s.config.maxCaptures()) {
+			s.logger.Printf("Capture limit of %d reached, rejecting preview for %s", s.config.maxCaptures(), camera.Name)
+			w.Header().Set("Retry-After", strconv.Itoa(int(duration.Seconds())+1))
+			http.Error(w, "Too many previews in progress", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.captures.release()
+
+		// Bound the capture so a dead camera can't hold the request open
+		ctx, cancel := context.WithTimeout(r.Context(), duration+15*time.Second)
+		defer cancel()
+
+		s.logger.Printf("Generating %v preview GIF for %s (%s)", duration, camera.Name, cameraID)
+		cmd := s.ffmpegCommand(ctx, buildPreviewArgs(s.withCameraDefaults(camera), s.selectRTSPURL(camera), fps, width, duration)...)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		err := s.runFFmpeg(cmd)
+		output := stdout.Bytes()
+		if err != nil || len(output) == 0 {
+			s.logger.Printf("Failed to generate preview for %s: %v", camera.Name, err)
+			http.Error(w, "Failed to generate preview", http.StatusBadGateway)
+			return
+		}
+
+		data = output
+		s.previews.put(cameraID, data)
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+	w.Write(data)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	publishRestartMin = 2 * time.Second
+	publishRestartMax = time.Minute
+	// publishStableAfter is how long FFmpeg must run before the restart backoff resets
+	publishStableAfter = time.Minute
+)
+
+// PublishConfig pushes a camera continuously to an external RTMP or SRT server
+type PublishConfig struct {
+	URL       string `json:"url"`                  // rtmp://, rtmps:// or srt:// destination
+	Format    string `json:"format,omitempty"`     // Optional, defaults to flv for RTMP and mpegts for SRT
+	CopyVideo bool   `json:"copy_video,omitempty"` // Forward the camera's video without re-encoding
+}
+
+// PublishStatus is the live state of one camera's publish process
+type PublishStatus struct {
+	Destination string    `json:"destination"`
+	Running     bool      `json:"running"`
+	Since       time.Time `json:"since"`
+	Restarts    int       `json:"restarts"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// publishers tracks the status of every publishing camera
+type publishers struct {
+	mu     sync.Mutex
+	status map[string]*PublishStatus
+}
+
+func (p *publishers) update(cameraID string, fn func(*PublishStatus)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status == nil {
+		p.status = make(map[string]*PublishStatus)
+	}
+	if p.status[cameraID] == nil {
+		p.status[cameraID] = &PublishStatus{}
+	}
+	fn(p.status[cameraID])
+}
+
+// remove forgets the status of a camera that no longer publishes
+func (p *publishers) remove(cameraID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.status, cameraID)
+}
+
+// snapshot returns a copy of all publish statuses
+func (p *publishers) snapshot() map[string]PublishStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]PublishStatus, len(p.status))
+	for id, status := range p.status {
+		out[id] = *status
+	}
+	return out
+}
+
+// publishFormat returns the FFmpeg muxer for the destination
+func (p *PublishConfig) publishFormat() (string, error) {
+	if p.Format != "" {
+		return p.Format, nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid publish URL: %v", err)
+	}
+	switch u.Scheme {
+	case "rtmp", "rtmps":
+		return "flv", nil
+	case "srt":
+		return "mpegts", nil
+	}
+	return "", fmt.Errorf("unsupported publish URL scheme %q, expected rtmp, rtmps or srt", u.Scheme)
+}
+
+// redactedDestination returns the publish URL without its stream key or credentials
+func (p *PublishConfig) redactedDestination() string {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// buildPublishArgs returns FFmpeg args that pull the camera and push it to the destination
+func buildPublishArgs(camera Camera, rtspURL, format string) []string {
+	buffering, _ := camera.bufferingOptions()
+
+	args := camera.rtspInputArgs()
+	args = append(args, buffering.inputArgs()...)
+	args = append(args, "-i", rtspURL)
+
+	if camera.Publish.CopyVideo {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, camera.filterArgs(softwareEncoding)...)
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-tune", "zerolatency",
+			"-b:v", "2M",
+			"-maxrate", "2M",
+			"-bufsize", "4M",
+			"-g", "30",
+		)
+	}
+
+	if camera.audioDisabled() {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	return append(args,
+		"-f", format,
+		camera.Publish.URL,
+	)
+}
+
+// startPublisher launches the camera's supervised publish process as part of
+// task, if Publish is configured
+func (s *Server) startPublisher(task *cameraTask, cameraID string, camera Camera) error {
+	if camera.Publish == nil {
+		return nil
+	}
+	format, err := camera.Publish.publishFormat()
+	if err != nil {
+		return fmt.Errorf("camera %s: %v", cameraID, err)
+	}
+
+	s.publishers.update(cameraID, func(st *PublishStatus) {
+		st.Destination = camera.Publish.redactedDestination()
+	})
+	s.goTask(task, func() {
+		s.supervisePublish(task.ctx, cameraID, camera, format)
+	})
+	return nil
+}
+
+// supervisePublish keeps FFmpeg publishing until ctx is cancelled, restarting it with backoff when it exits
+func (s *Server) supervisePublish(ctx context.Context, cameraID string, camera Camera, format string) {
+	camera = s.withCameraDefaults(camera)
+	backoff := publishRestartMin
+
+	for {
+		s.logger.Printf("Publishing %s to %s", camera.Name, camera.Publish.redactedDestination())
+
+		var stderr bytes.Buffer
+		cmd := s.ffmpegCommand(ctx, buildPublishArgs(camera, s.selectRTSPURL(camera), format)...)
+		cmd.Stderr = &stderr
+
+		started := time.Now()
+		err := s.startFFmpeg(cmd)
+		if err == nil {
+			s.metrics.ffmpegStarted(cameraID, "publish")
+			s.publishers.update(cameraID, func(st *PublishStatus) {
+				st.Running = true
+				st.Since = started
+			})
+			err = cmd.Wait()
+		}
+
+		if ctx.Err() != nil {
+			s.publishers.update(cameraID, func(st *PublishStatus) { st.Running = false })
+			return
+		}
+
+		reason := lastLine(stderr.String())
+		if reason == "" && err != nil {
+			reason = err.Error()
+		}
+		s.metrics.ffmpegFailed(cameraID, "publish")
+		s.publishers.update(cameraID, func(st *PublishStatus) {
+			st.Running = false
+			st.Restarts++
+			st.LastError = reason
+		})
+
+		if time.Since(started) > publishStableAfter {
+			backoff = publishRestartMin
+		}
+		s.logger.Printf("Publish for %s exited (%s), restarting in %v", camera.Name, reason, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > publishRestartMax {
+			backoff = publishRestartMax
+		}
+	}
+}
+
+// lastLine returns the last non-empty line of FFmpeg output for logging.
+// FFmpeg prefixes input errors with the URL, so credentials are masked.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return redactCredentials(strings.TrimSpace(lines[len(lines)-1]))
+}
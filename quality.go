@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// qualityLevels are the ?quality= values /stream/ accepts, lowest first
+var qualityLevels = []string{"low", "medium", "high"}
+
+const defaultQuality = "medium"
+
+// QualityProfile adjusts a camera's /stream/ encoding for one ?quality=
+// level. Unset fields keep the camera's own setting.
+type QualityProfile struct {
+	Height       int    `json:"height,omitempty"`        // Maximum output height in pixels, never upscaled; 0 keeps the camera's resolution
+	VideoBitrate string `json:"video_bitrate,omitempty"` // Maximum bitrate, e.g. "500k"
+	Framerate    int    `json:"framerate,omitempty"`
+	CRF          int    `json:"crf,omitempty"`
+}
+
+// defaultQualityProfiles are used for the levels quality_profiles doesn't
+// set. medium is the camera's own encoding, so /stream/ URLs without
+// ?quality= are unchanged.
+var defaultQualityProfiles = map[string]QualityProfile{
+	"low":    {Height: 360, VideoBitrate: "500k", Framerate: 10, CRF: 32},
+	"medium": {},
+	"high":   {VideoBitrate: "4M", CRF: 23},
+}
+
+// validateQualityProfiles checks the configured quality levels
+func (c *Config) validateQualityProfiles() error {
+	names := make([]string, 0, len(c.QualityProfiles))
+	for name := range c.QualityProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		profile := c.QualityProfiles[name]
+		if _, known := defaultQualityProfiles[name]; !known {
+			problems = append(problems, fmt.Sprintf("quality_profiles: unknown level %q, expected one of %s", name, strings.Join(qualityLevels, ", ")))
+			continue
+		}
+		if profile.Height != 0 && (profile.Height < 16 || profile.Height > 4320) {
+			problems = append(problems, fmt.Sprintf("quality_profiles.%s: height must be between 16 and 4320", name))
+		}
+		if err := (Camera{VideoBitrate: profile.VideoBitrate, Framerate: profile.Framerate, CRF: profile.CRF}).validateEncoding(); err != nil {
+			problems = append(problems, fmt.Sprintf("quality_profiles.%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// qualityProfile returns the profile of a quality level
+func (c *Config) qualityProfile(quality string) QualityProfile {
+	if profile, ok := c.QualityProfiles[quality]; ok {
+		return profile
+	}
+	return defaultQualityProfiles[quality]
+}
+
+// streamQuality returns the request's ?quality= level, medium when it is
+// missing or unknown
+func streamQuality(r *http.Request) string {
+	quality := r.URL.Query().Get("quality")
+	if _, known := defaultQualityProfiles[quality]; !known {
+		return defaultQuality
+	}
+	return quality
+}
+
+// withQuality returns camera with the profile's settings in place of its own
+func (c Camera) withQuality(profile QualityProfile) Camera {
+	if profile.VideoBitrate != "" {
+		c.VideoBitrate = profile.VideoBitrate
+	}
+	if profile.Framerate > 0 {
+		c.Framerate = profile.Framerate
+	}
+	if profile.CRF > 0 {
+		c.CRF = profile.CRF
+	}
+	c.maxHeight = profile.Height
+	return c
+}
+
+// scaleFilter returns the filter that shrinks the video to maxHeight, or ""
+// when the camera's resolution is kept
+func (c Camera) scaleFilter() string {
+	if c.maxHeight <= 0 {
+		return ""
+	}
+	// Quoted so the comma in min() isn't read as the next filter
+	return fmt.Sprintf("scale=-2:'min(%d,ih)'", c.maxHeight)
+}
+
+// streamQualities describes each ?quality= level of the camera's /stream/
+// and its HLS variant for the camera API, with the camera's own settings
+// filled in
+func (s *Server) streamQualities(cameraID string, camera Camera) []map[string]interface{} {
+	qualities := make([]map[string]interface{}, 0, len(qualityLevels))
+	for _, level := range qualityLevels {
+		profile := s.config.qualityProfile(level)
+		_, crf, bitrate, framerate := camera.withQuality(profile).encodeSettings()
+		quality := map[string]interface{}{
+			"name":          level,
+			"stream_url":    fmt.Sprintf("/stream/%s?quality=%s", cameraID, level),
+			"hls_url":       fmt.Sprintf("/hls/%s/%s/%s", cameraID, level, hlsPlaylist),
+			"video_bitrate": bitrate,
+			"framerate":     framerate,
+			"crf":           crf,
+			"default":       level == defaultQuality,
+		}
+		if profile.Height > 0 {
+			quality["max_height"] = profile.Height
+		}
+		qualities = append(qualities, quality)
+	}
+	return qualities
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRateLimitBurst = 20
+	// Limiters of clients idle this long are dropped; a returning client
+	// starts with a full bucket, as it would have refilled by then anyway
+	rateLimiterIdle       = 3 * time.Minute
+	rateLimiterGCInterval = time.Minute
+)
+
+// rateLimitBurst returns the configured burst or the default
+func (c *Config) rateLimitBurst() int {
+	if c.RateLimitBurst > 0 {
+		return c.RateLimitBurst
+	}
+	return defaultRateLimitBurst
+}
+
+// validateRateLimit checks the rate limit settings
+func (c *Config) validateRateLimit() error {
+	if c.RateLimitRPS < 0 || math.IsNaN(c.RateLimitRPS) || math.IsInf(c.RateLimitRPS, 0) {
+		return fmt.Errorf("rate_limit_rps must be a positive number")
+	}
+	if c.RateLimitBurst < 0 {
+		return fmt.Errorf("rate_limit_burst must be positive")
+	}
+	return nil
+}
+
+// clientLimiter is one client's token bucket
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiters holds a token bucket per client IP
+type rateLimiters struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+func newRateLimiters(rps float64, burst int) *rateLimiters {
+	return &rateLimiters{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// allow takes a token for ip, returning how long to wait if none is left
+func (l *rateLimiters) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := client.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+	// Rejected requests don't spend the tokens of later ones
+	reservation.CancelAt(now)
+	return false, delay
+}
+
+// prune drops the limiters of clients not seen since cutoff
+func (l *rateLimiters) prune(cutoff time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	removed := 0
+	for ip, client := range l.clients {
+		if client.lastSeen.Before(cutoff) {
+			delete(l.clients, ip)
+			removed++
+		}
+	}
+	return removed
+}
+
+// runGC prunes idle clients until ctx is done
+func (l *rateLimiters) runGC(ctx context.Context) {
+	ticker := time.NewTicker(rateLimiterGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.prune(now.Add(-rateLimiterIdle))
+		}
+	}
+}
+
+// startRateLimiter creates the per-client limiters when rate_limit_rps is set
+func (s *Server) startRateLimiter() {
+	if s.config.RateLimitRPS <= 0 {
+		return
+	}
+	s.rateLimiters = newRateLimiters(s.config.RateLimitRPS, s.config.rateLimitBurst())
+	s.logger.Printf("Rate limiting clients to %g requests/s, burst %d", s.config.RateLimitRPS, s.config.rateLimitBurst())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.rateLimiters.runGC(s.ctx)
+	}()
+}
+
+// withRateLimit answers 429 to clients over their request rate. /healthz is
+// exempt so monitoring keeps working while a client is being limited.
+func (s *Server) withRateLimit(next http.Handler) http.Handler {
+	if s.rateLimiters == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := s.clientIP(r)
+		if ok, delay := s.rateLimiters.allow(ip, time.Now()); !ok {
+			s.metrics.rateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// requestReconnect asks the tunnel monitor to rebuild the SSH tunnel, re-reading
+// the key, and waits for the outcome
+func (s *Server) requestReconnect(ctx context.Context) error {
+	if mode := s.currentTunnelMode(); mode != tunnelGoSSH {
+		return fmt.Errorf("the %s tunnel can't be reconnected in place, restart the service instead", mode)
+	}
+	done := make(chan error, 1)
+	select {
+	case s.reconnectRequests <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleTunnelReconnect reconnects the SSH tunnel on POST, for auth_username only
+func (s *Server) handleTunnelReconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	s.logger.Printf("SSH reconnect requested by %s", r.RemoteAddr)
+	if err := s.requestReconnect(r.Context()); err != nil {
+		writeJSONError(w, fmt.Sprintf("Reconnect failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "reconnected"})
+}
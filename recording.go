@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRecordDir           = "recordings"
+	defaultRecordSegmentLength = 10 * time.Minute
+	defaultRecordRetentionMB   = 10 * 1024
+	// recordPruneInterval is how often a camera's recordings are checked against its retention size
+	recordPruneInterval = time.Minute
+	recordRestartMin    = 2 * time.Second
+	recordRestartMax    = time.Minute
+	recordStableAfter   = time.Minute
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// RecordConfig enables continuous recording of a camera into segmented MP4 files
+type RecordConfig struct {
+	Enabled bool `json:"enabled"`
+	// Daily window in local time, optional; both unset records around the
+	// clock, and an end before the start spans midnight
+	Start         string   `json:"start,omitempty"`          // "HH:MM"
+	End           string   `json:"end,omitempty"`            // "HH:MM"
+	Days          []string `json:"days,omitempty"`           // e.g. ["mon", "tue"], defaults to every day
+	OutputDir     string   `json:"output_dir,omitempty"`     // Defaults to recordings/<camera id>
+	SegmentLength Duration `json:"segment_length,omitempty"` // Defaults to 10m
+	RetentionMB   int64    `json:"retention_mb,omitempty"`   // Oldest segments are deleted beyond this total, defaults to 10240
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, herr := strconv.Atoi(hours)
+	m, merr := strconv.Atoi(minutes)
+	if !ok || herr != nil || merr != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return h*60 + m, nil
+}
+
+// validate checks the schedule and sizes
+func (c *RecordConfig) validate() error {
+	if (c.Start == "") != (c.End == "") {
+		return fmt.Errorf("record: start and end must be set together")
+	}
+	if c.Start != "" {
+		if _, err := parseClock(c.Start); err != nil {
+			return fmt.Errorf("record: start: %v", err)
+		}
+		if _, err := parseClock(c.End); err != nil {
+			return fmt.Errorf("record: end: %v", err)
+		}
+		if c.Start == c.End {
+			return fmt.Errorf("record: start and end must differ")
+		}
+	}
+	for _, day := range c.Days {
+		if _, ok := weekdayNames[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("record: unknown day %q, expected e.g. \"mon\"", day)
+		}
+	}
+	if c.SegmentLength < 0 || (c.SegmentLength > 0 && time.Duration(c.SegmentLength) < time.Second) {
+		return fmt.Errorf("record: segment_length must be at least 1s")
+	}
+	if c.RetentionMB < 0 {
+		return fmt.Errorf("record: retention_mb must be positive")
+	}
+	return nil
+}
+
+// activeAt reports whether t falls inside the recording schedule
+func (c *RecordConfig) activeAt(t time.Time) bool {
+	if len(c.Days) > 0 {
+		today := false
+		for _, day := range c.Days {
+			today = today || weekdayNames[strings.ToLower(day)] == t.Weekday()
+		}
+		if !today {
+			return false
+		}
+	}
+	if c.Start == "" {
+		return true
+	}
+
+	start, _ := parseClock(c.Start)
+	end, _ := parseClock(c.End)
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// nextChange returns the next minute at which activeAt flips, or the zero
+// time if the schedule is the same for the coming week
+func (c *RecordConfig) nextChange(t time.Time) time.Time {
+	active := c.activeAt(t)
+	limit := t.Add(8 * 24 * time.Hour)
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Before(limit); m = m.Add(time.Minute) {
+		if c.activeAt(m) != active {
+			return m
+		}
+	}
+	return time.Time{}
+}
+
+// segmentLength returns the configured segment length or the default
+func (c *RecordConfig) segmentLength() time.Duration {
+	if c.SegmentLength > 0 {
+		return time.Duration(c.SegmentLength)
+	}
+	return defaultRecordSegmentLength
+}
+
+// retentionBytes returns the size cap for a camera's recordings
+func (c *RecordConfig) retentionBytes() int64 {
+	if c.RetentionMB > 0 {
+		return c.RetentionMB * 1024 * 1024
+	}
+	return defaultRecordRetentionMB * 1024 * 1024
+}
+
+// recordDir returns the directory holding cameraID's recordings
+func (s *Server) recordDir(cameraID string, cfg *RecordConfig) string {
+	if cfg.OutputDir != "" {
+		return s.expandPath(cfg.OutputDir)
+	}
+	return filepath.Join(defaultRecordDir, cameraID)
+}
+
+// buildRecordArgs returns FFmpeg args that copy the camera's video into
+// timestamped MP4 segments in dir. Audio is converted to AAC because many
+// cameras send G.711, which MP4 can't hold, or dropped with no_audio. Only
+// errors are logged, since the recorder's stderr is kept for hours.
+func buildRecordArgs(camera Camera, rtspURL, dir string, segment time.Duration) []string {
+	buffering, _ := camera.bufferingOptions()
+
+	args := append([]string{"-loglevel", "error"}, camera.rtspInputArgs()...)
+	args = append(args, buffering.inputArgs()...)
+	args = append(args, camera.probeArgs()...)
+	args = append(args, "-i", rtspURL, "-c:v", "copy")
+	if camera.audioDisabled() {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", "aac")
+	}
+	return append(args,
+		"-f", "segment",
+		"-segment_time", strconv.FormatFloat(segment.Seconds(), 'f', -1, 64),
+		"-segment_atclocktime", "1",
+		"-segment_format", "mp4",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(dir, "%Y%m%d-%H%M%S.mp4"),
+	)
+}
+
+// startRecorder starts the camera's scheduled recorder and pruner as part of
+// task, if Record is enabled
+func (s *Server) startRecorder(task *cameraTask, cameraID string, camera Camera) error {
+	if camera.Record == nil || !camera.Record.Enabled {
+		return nil
+	}
+	dir := s.recordDir(cameraID, camera.Record)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("camera %s: failed to create recording directory: %v", cameraID, err)
+	}
+
+	s.goTask(task, func() {
+		s.superviseRecording(task.ctx, cameraID, camera, dir)
+	})
+	s.goTask(task, func() {
+		s.runRecordPruner(task.ctx, camera, dir)
+	})
+	return nil
+}
+
+// superviseRecording runs FFmpeg while the schedule is active, waiting out
+// the gaps, and restarts it with backoff if it exits early
+func (s *Server) superviseRecording(ctx context.Context, cameraID string, camera Camera, dir string) {
+	camera = s.withCameraDefaults(camera)
+	cfg := camera.Record
+	backoff := recordRestartMin
+
+	for {
+		now := time.Now()
+		change := cfg.nextChange(now)
+
+		if !cfg.activeAt(now) {
+			if change.IsZero() {
+				s.logger.Printf("Recording for %s has no active window", camera.Name)
+				<-ctx.Done()
+				return
+			}
+			s.logger.Printf("Recording for %s paused until %s", camera.Name, change.Format("Mon 15:04"))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(change)):
+			}
+			continue
+		}
+
+		// The recorder is stopped at the end of the window like at shutdown
+		var windowCtx context.Context
+		var cancel context.CancelFunc
+		if change.IsZero() {
+			windowCtx, cancel = context.WithCancel(ctx)
+		} else {
+			windowCtx, cancel = context.WithDeadline(ctx, change)
+		}
+
+		s.logger.Printf("Recording %s to %s", camera.Name, dir)
+		var stderr bytes.Buffer
+		cmd := s.ffmpegCommand(windowCtx, buildRecordArgs(camera, s.selectRTSPURL(camera), dir, cfg.segmentLength())...)
+		cmd.Stderr = &stderr
+
+		started := time.Now()
+		err := s.startFFmpeg(cmd)
+		if err == nil {
+			s.metrics.ffmpegStarted(cameraID, "record")
+			unregister := s.work.add(fmt.Sprintf("%s recording", cameraID), closerFunc(func() error {
+				return cmd.Process.Kill()
+			}))
+			err = cmd.Wait()
+			unregister()
+		}
+		windowOver := windowCtx.Err() != nil
+		cancel()
+
+		if ctx.Err() != nil {
+			s.logger.Printf("Recording for %s stopped", camera.Name)
+			return
+		}
+		if windowOver {
+			s.logger.Printf("Recording window for %s ended", camera.Name)
+			backoff = recordRestartMin
+			continue
+		}
+
+		reason := lastLine(stderr.String())
+		if reason == "" && err != nil {
+			reason = err.Error()
+		}
+		s.metrics.ffmpegFailed(cameraID, "record")
+		if time.Since(started) > recordStableAfter {
+			backoff = recordRestartMin
+		}
+		s.logger.Printf("Recording for %s exited (%s), restarting in %v", camera.Name, reason, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > recordRestartMax {
+			backoff = recordRestartMax
+		}
+	}
+}
+
+// runRecordPruner keeps a camera's recordings within its retention size until ctx is cancelled
+func (s *Server) runRecordPruner(ctx context.Context, camera Camera, dir string) {
+	limit := camera.Record.retentionBytes()
+	ticker := time.NewTicker(recordPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if removed, err := pruneRecordings(dir, limit); err != nil {
+			s.logger.Printf("Failed to prune recordings for %s: %v", camera.Name, err)
+		} else if removed > 0 {
+			s.logger.Printf("Pruned %d old recording(s) for %s to stay under %d MB", removed, camera.Name, limit/(1024*1024))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneRecordings deletes the oldest segments in dir until the total size
+// is at most limit. The newest segment is never removed because FFmpeg may
+// still be writing it.
+func pruneRecordings(dir string, limit int64) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	type segment struct {
+		path string
+		size int64
+	}
+	var segments []segment
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".mp4" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{filepath.Join(dir, entry.Name()), info.Size()})
+		total += info.Size()
+	}
+	// Timestamped names sort oldest first
+	sort.Slice(segments, func(i, j int) bool { return segments[i].path < segments[j].path })
+
+	removed := 0
+	for i := 0; i < len(segments)-1 && total > limit; i++ {
+		if err := os.Remove(segments[i].path); err != nil {
+			return removed, err
+		}
+		total -= segments[i].size
+		removed++
+	}
+	return removed, nil
+}
+
+// recordingNameLayout is the start time encoded in a segment's file name by
+// buildRecordArgs
+const recordingNameLayout = "20060102-150405"
+
+// recordingIndexFile is the per-day WebVTT timeline under /recordings/{id}/{date}/
+const recordingIndexFile = "index.vtt"
+
+// recordedSegment is one MP4 file of a camera's recordings
+type recordedSegment struct {
+	File  string
+	Start time.Time
+	End   time.Time
+}
+
+// listRecordings returns the segments in dir that started on day, oldest
+// first. Each ends when the next one starts or after segment, whichever is
+// earlier; the newest ends at its last write if FFmpeg is still on it. The
+// directory is read on every call, so segments written or pruned since the
+// last request are always reflected.
+func listRecordings(dir string, day time.Time, segment time.Duration) ([]recordedSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []recordedSegment
+	var modTimes []time.Time
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".mp4" {
+			continue
+		}
+		start, err := time.ParseInLocation(recordingNameLayout, strings.TrimSuffix(name, ".mp4"), day.Location())
+		if err != nil || start.Year() != day.Year() || start.YearDay() != day.YearDay() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, recordedSegment{File: name, Start: start})
+		modTimes = append(modTimes, info.ModTime())
+	}
+	// ReadDir sorts by name, and timestamped names sort oldest first
+	for i := range segments {
+		end := segments[i].Start.Add(segment)
+		if i+1 < len(segments) && segments[i+1].Start.Before(end) {
+			end = segments[i+1].Start
+		}
+		if i == len(segments)-1 && modTimes[i].After(segments[i].Start) && modTimes[i].Before(end) {
+			end = modTimes[i]
+		}
+		segments[i].End = end
+	}
+	return segments, nil
+}
+
+// writeRecordingIndex writes segments as a WebVTT file with one cue per
+// segment, timed from midnight of day, whose text is the segment's URL
+func writeRecordingIndex(w io.Writer, cameraID string, day time.Time, segments []recordedSegment) {
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	fmt.Fprint(w, "WEBVTT\n")
+	for _, segment := range segments {
+		fmt.Fprintf(w, "\n%s\n%s --> %s\n/recordings/%s/%s\n", segment.File,
+			vttTimestamp(segment.Start.Sub(midnight)), vttTimestamp(segment.End.Sub(midnight)), cameraID, segment.File)
+	}
+}
+
+// vttTimestamp formats d as a WebVTT cue time, hh:mm:ss.ttt
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// handleRecordings serves /recordings/{id}/{date}/index.vtt, a timeline of
+// the segments recorded on date (YYYY-MM-DD, local time), and the segment
+// files it links to at /recordings/{id}/{file}.mp4
+func (s *Server) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/recordings/"), "/")
+	cameraID := parts[0]
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+	if camera.Record == nil {
+		http.NotFound(w, r)
+		return
+	}
+	dir := s.recordDir(cameraID, camera.Record)
+
+	switch {
+	case len(parts) == 3 && parts[2] == recordingIndexFile:
+		day, err := time.ParseInLocation("2006-01-02", parts[1], time.Local)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid date %q, expected YYYY-MM-DD", parts[1]), http.StatusBadRequest)
+			return
+		}
+		segments, err := listRecordings(dir, day, camera.Record.segmentLength())
+		if err != nil && !os.IsNotExist(err) {
+			s.logger.Printf("Failed to list recordings for %s: %v", camera.Name, err)
+			http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeRecordingIndex(w, cameraID, day, segments)
+	case len(parts) == 2 && filepath.Ext(parts[1]) == ".mp4" && filepath.Base(parts[1]) == parts[1]:
+		http.ServeFile(w, r, filepath.Join(dir, parts[1]))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordingIndex(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	written := day.Add(8*time.Hour + 23*time.Minute)
+	for name, modTime := range map[string]time.Time{
+		"20240531-235000.mp4": day, // Previous day
+		"20240601-080000.mp4": day.Add(8*time.Hour + 10*time.Minute),
+		"20240601-081000.mp4": day.Add(8*time.Hour + 20*time.Minute),
+		"20240601-082000.mp4": written, // Still being written
+		"notes.txt":           day,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := listRecordings(dir, day, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("listRecordings: %v", err)
+	}
+	var vtt strings.Builder
+	writeRecordingIndex(&vtt, "front", day, segments)
+
+	want := `WEBVTT
+
+20240601-080000.mp4
+08:00:00.000 --> 08:10:00.000
+/recordings/front/20240601-080000.mp4
+
+20240601-081000.mp4
+08:10:00.000 --> 08:20:00.000
+/recordings/front/20240601-081000.mp4
+
+20240601-082000.mp4
+08:20:00.000 --> 08:23:00.000
+/recordings/front/20240601-082000.mp4
+`
+	if vtt.String() != want {
+		t.Errorf("index.vtt =\n%s\nwant\n%s", vtt.String(), want)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// rediscoveryTimeout is how long a scheduled ONVIF scan waits for answers,
+// the same as the -discover-timeout default
+const rediscoveryTimeout = 3 * time.Second
+
+// runRediscovery re-scans the LAN for ONVIF cameras every
+// rediscovery_interval and follows cameras whose device now answers from a
+// different address, such as after a new DHCP lease
+func (s *Server) runRediscovery() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(s.config.RediscoveryInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Idle shutdown stops scanning the network too
+		if s.quiesced.Load() {
+			continue
+		}
+
+		devices, err := discoverONVIF(rediscoveryTimeout, s.logger)
+		if err != nil {
+			s.logger.Printf("ONVIF rediscovery failed: %v", err)
+			continue
+		}
+		s.applyRediscovery(devices)
+	}
+}
+
+// applyRediscovery points the rtsp_url of every camera whose onvif_id is
+// among devices at the address the device answered from, keeping the rest
+// of the URL and the camera's other settings. The cameras are saved to the
+// config file, and those that moved are applied as Reload applies an edited
+// camera.
+func (s *Server) applyRediscovery(devices []onvifDevice) {
+	hosts := make(map[string]string, len(devices))
+	for _, device := range devices {
+		if u, err := url.Parse(device.XAddrs[0]); err == nil && u.Hostname() != "" {
+			hosts[device.Address] = u.Hostname()
+		}
+	}
+
+	s.camerasMu.Lock()
+	cameras := make(map[string]Camera, len(s.config.Cameras))
+	var moved []string
+	previous := make(map[string]Camera)
+	for cameraID, camera := range s.config.Cameras {
+		cameras[cameraID] = camera
+		host, found := hosts[camera.ONVIFID]
+		if camera.ONVIFID == "" || !found {
+			continue
+		}
+		rtspURL, changed, err := withRTSPHost(camera.RTSPURL, host)
+		if err != nil {
+			s.logger.Printf("Camera %s: cannot update rtsp_url for its new address %s: %v", cameraID, host, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		s.logger.Printf("Camera %s (%s) answered ONVIF discovery from %s, updating rtsp_url from %s to %s",
+			camera.Name, cameraID, host, redactRTSP(camera.RTSPURL), redactRTSP(rtspURL))
+		previous[cameraID] = camera
+		camera.RTSPURL = rtspURL
+		cameras[cameraID] = camera
+		moved = append(moved, cameraID)
+	}
+	if len(moved) == 0 {
+		s.camerasMu.Unlock()
+		return
+	}
+	err := s.commitCameras(cameras)
+	s.camerasMu.Unlock()
+	if err != nil {
+		s.logger.Printf("Failed to apply rediscovered camera addresses: %v", err)
+		return
+	}
+
+	sort.Strings(moved)
+	for _, cameraID := range moved {
+		s.applyCameraChange(cameraID, previous[cameraID], cameras[cameraID])
+	}
+}
+
+// withRTSPHost returns rtspURL with its host replaced by host, keeping the
+// credentials, port and path, and whether that changed anything
+func withRTSPHost(rtspURL, host string) (string, bool, error) {
+	u, err := url.Parse(rtspURL)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid rtsp_url: %v", redactCredentials(err.Error()))
+	}
+	if u.Hostname() == host {
+		return rtspURL, false, nil
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	return u.String(), true, nil
+}
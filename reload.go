@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// setTemplates swaps in a parsed template set
+func (s *Server) setTemplates(templates *template.Template) {
+	s.templatesMu.Lock()
+	defer s.templatesMu.Unlock()
+	s.templates = templates
+}
+
+// htmlTemplates returns the current template set
+func (s *Server) htmlTemplates() *template.Template {
+	s.templatesMu.RLock()
+	defer s.templatesMu.RUnlock()
+	return s.templates
+}
+
+// restartOnlyChanges returns the JSON names of the fields other than
+// cameras that differ between the running config and next
+func restartOnlyChanges(running, next *Config) []string {
+	var changed []string
+	rv, nv := reflect.ValueOf(*running), reflect.ValueOf(*next)
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if field.Name == "Cameras" {
+			continue
+		}
+		if !reflect.DeepEqual(rv.Field(i).Interface(), nv.Field(i).Interface()) {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Reload re-reads the config file and applies camera changes to the running
+// server, along with the HTML templates. Streams of removed cameras are
+// stopped, and changed cameras are applied by applyCameraChange. Everything
+// else, such as the VPS and SSH settings, is only logged as requiring a
+// restart; the tunnel and unchanged cameras' streams keep running.
+func (s *Server) Reload() error {
+	if s.configPath == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+
+	// Held from reading the file to the swap, so an API change saved in
+	// between isn't overwritten by the older cameras read here
+	s.camerasMu.Lock()
+	previous, next, err := s.loadReload()
+	s.camerasMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var added, removed, changed []string
+	for cameraID, camera := range next.Cameras {
+		old, exists := previous[cameraID]
+		if exists && reflect.DeepEqual(old, camera) {
+			continue
+		}
+		if exists {
+			changed = append(changed, cameraID)
+			s.applyCameraChange(cameraID, old, camera)
+			continue
+		}
+		added = append(added, cameraID)
+		if err := s.startCameraTasks(cameraID, camera); err != nil {
+			s.logger.Printf("Camera %s: failed to start publish, sprites or record: %v", cameraID, err)
+		}
+	}
+	for cameraID := range previous {
+		if _, exists := next.Cameras[cameraID]; !exists {
+			removed = append(removed, cameraID)
+			s.stopCameraStreams(cameraID)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	if templates, _, err := parseTemplates(); err != nil {
+		s.logger.Printf("Warning: Could not reload templates, keeping the current ones: %v", err)
+	} else {
+		s.setTemplates(templates)
+	}
+
+	s.logger.Printf("Reloaded %s: added %v, removed %v, changed %v", s.configPath, added, removed, changed)
+	return nil
+}
+
+// applyCameraChange puts an edited camera's settings into effect while
+// restarting as little as possible. Every FFmpeg reads the camera and
+// encodes in one process, so a transcode can't keep its RTSP session while
+// only its encoder restarts; instead:
+//   - a change only to how the camera is listed leaves its streams alone
+//   - a change to who may view it stops its viewer streams, cutting off
+//     viewers who may no longer watch
+//   - any other change restarts its viewer transcodes make-before-break as
+//     POST /api/cameras/{id}/restart does, so viewers stay on if the video
+//     format is unchanged
+//
+// Its publish, sprites and record tasks are restarted only if their FFmpeg
+// arguments or settings changed.
+func (s *Server) applyCameraChange(cameraID string, old, camera Camera) {
+	switch {
+	case reflect.DeepEqual(viewerSettings(old), viewerSettings(camera)):
+	case !reflect.DeepEqual(old.PublicExposure, camera.PublicExposure) || !reflect.DeepEqual(old.AllowedUsers, camera.AllowedUsers) || !s.hasFFmpeg():
+		s.stopViewerStreams(cameraID)
+	default:
+		if _, err := s.restartStreams(cameraID, camera); err != nil {
+			// The old transcodes still have the old settings
+			s.logger.Printf("Camera %s: failed to restart stream, stopping it: %v", cameraID, err)
+			s.stopViewerStreams(cameraID)
+			break
+		}
+		s.restartFrameSource(cameraID, camera)
+		s.stopViewerTranscodes(cameraID)
+	}
+
+	tasks, err := s.updateCameraTasks(cameraID, camera, false)
+	if err != nil {
+		s.logger.Printf("Camera %s: failed to start publish, sprites or record: %v", cameraID, err)
+	} else if len(tasks) > 0 {
+		s.logger.Printf("Camera %s: restarted %s", cameraID, strings.Join(tasks, ", "))
+	}
+}
+
+// viewerSettings returns camera without the settings no viewer transcode's
+// FFmpeg reads: how the camera is listed, and its background tasks, which
+// updateCameraTasks compares on their own
+func viewerSettings(camera Camera) Camera {
+	camera.Name = ""
+	camera.Slug = ""
+	camera.ONVIFID = ""
+	camera.Description = ""
+	camera.Group = ""
+	camera.Publish = nil
+	camera.Sprites = nil
+	camera.Record = nil
+	return camera
+}
+
+// loadReload reads and validates the config file and swaps its cameras in,
+// returning the cameras it replaced. Callers hold camerasMu.
+func (s *Server) loadReload() (map[string]Camera, *Config, error) {
+	next, err := loadConfig(s.configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.overrides != nil {
+		s.overrides.apply(next)
+	}
+	if err := next.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid config %s: %v", s.configPath, err)
+	}
+	slugs, err := buildSlugIndex(next.Cameras)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range restartOnlyChanges(s.config, next) {
+		s.logger.Printf("Config %s changed; requires restart, keeping the running value", name)
+	}
+
+	previous := s.config.Cameras
+	s.config.Cameras = next.Cameras
+	s.slugs = slugs
+	return previous, next, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// TestReloadRestartsOnlyChangedWork edits a camera with a viewer and a
+// recorder running and checks each reload restarts only what the edit
+// reaches: nothing for a new description, the viewer's transcode but not the
+// recorder for a new CRF, and the viewer's stream ending when who may watch
+// changes
+func TestReloadRestartsOnlyChangedWork(t *testing.T) {
+	ffmpeg, _ := fakeFFmpeg(t)
+	camera := Camera{
+		Name:    "Front",
+		RTSPURL: "rtsp://127.0.0.1:1/front",
+		Record:  &RecordConfig{Enabled: true, OutputDir: t.TempDir()},
+	}
+	config := &Config{
+		VPSHost:       "vps.example.com",
+		VPSPort:       22,
+		VPSUser:       "tunnel",
+		SSHPassword:   "hunter2",
+		LocalHTTPPort: 8080,
+		VPSHTTPPort:   8081,
+		FFmpegPath:    ffmpeg,
+		SkipPreflight: true,
+		Cameras:       map[string]Camera{"front": camera},
+	}
+	s := newTestAPIServer(t, config)
+	s.configPath = filepath.Join(t.TempDir(), "camera_config.json")
+	if err := s.startCameraTasks("front", camera); err != nil {
+		t.Fatal(err)
+	}
+
+	// reload saves the edited camera and reloads the file
+	reload := func(edit func(camera *Camera)) {
+		t.Helper()
+		edit(&camera)
+		saved := *config
+		saved.Cameras = map[string]Camera{"front": camera}
+		if err := saveConfig(&saved, s.configPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Reload(); err != nil {
+			t.Fatalf("Reload: %v", err)
+		}
+	}
+	current := func() (*streamBroadcaster, *cameraTask) {
+		s.streams.mu.Lock()
+		b := s.streams.broadcaster[streamKey{cameraID: "front", quality: defaultQuality}]
+		s.streams.mu.Unlock()
+		s.cameraTasks.mu.Lock()
+		defer s.cameraTasks.mu.Unlock()
+		return b, s.cameraTasks.tasks[taskKey{cameraID: "front", kind: taskRecord}]
+	}
+
+	viewer, err := s.request(http.MethodGet, "/stream/front", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Body.Close()
+	if viewer.StatusCode != http.StatusOK {
+		t.Fatalf("stream returned %d", viewer.StatusCode)
+	}
+	// readBoxes reads n boxes of the viewer's stream, failing on an error
+	readBoxes := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, _, err := readMP4Box(viewer.Body); err != nil {
+				t.Fatalf("viewer's stream: %v", err)
+			}
+		}
+	}
+	readBoxes(4)
+	stream, recorder := current()
+	if stream == nil || recorder == nil {
+		t.Fatal("the stream or recorder isn't running")
+	}
+
+	reload(func(camera *Camera) { camera.Description = "By the gate" })
+	if b, task := current(); b != stream || task != recorder {
+		t.Error("a new description restarted the stream or recorder")
+	}
+	readBoxes(2)
+
+	reload(func(camera *Camera) { camera.CRF = 23 })
+	b, task := current()
+	if b == stream {
+		t.Error("a new CRF didn't restart the stream")
+	}
+	if task != recorder {
+		t.Error("a new CRF restarted the recorder, which doesn't encode")
+	}
+	// The viewer moved to the new transcode, whose format is the same
+	readBoxes(4)
+
+	lanOnly := false
+	reload(func(camera *Camera) { camera.PublicExposure = &lanOnly })
+	if _, err := io.Copy(io.Discard, viewer.Body); err != nil {
+		t.Errorf("viewer's stream ended with %v, want EOF", err)
+	}
+	if _, task := current(); task != recorder {
+		t.Error("making the camera LAN-only restarted the recorder")
+	}
+}
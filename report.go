@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// StartupReport records the outcome of each self-check performed by Start
+type StartupReport struct {
+	FFmpegFound      bool     `json:"ffmpeg_found"`
+	FFmpegVersion    string   `json:"ffmpeg_version,omitempty"`
+	VideoEncoder     string   `json:"video_encoder,omitempty"` // e.g. "libx264" or "h264_nvenc"
+	CamerasTotal     int      `json:"cameras_total"`
+	CamerasReachable []string `json:"cameras_reachable"`
+	HTTPServerOK     bool     `json:"http_server_ok"`
+	SSHKeyLoaded     bool     `json:"ssh_key_loaded"`
+	TunnelBound      bool     `json:"tunnel_bound"`
+	TunnelMethod     string   `json:"tunnel_method,omitempty"` // "go-ssh" or "system-ssh"
+	Ready            bool     `json:"ready"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// writeStartupReport writes the report as JSON to path, or to stdout when path is "-"
+func writeStartupReport(report *StartupReport, path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// restartedStream is one shared transcode replaced by a camera restart
+type restartedStream struct {
+	Quality string `json:"quality"`
+	Viewers int    `json:"viewers"`
+	// Ended counts viewers whose stream was ended instead, because the new
+	// transcode's format differs from what their player was given
+	Ended int `json:"ended"`
+	// FormatChanged is set when the new transcode's init segment differs,
+	// as after most settings changes, so none of its viewers could move
+	FormatChanged bool `json:"format_changed"`
+}
+
+// handleCameraRestart serves POST /api/cameras/{id}/restart. It replaces the
+// camera's shared FFmpeg processes with ones started from its current
+// config, for a stream that has wedged or picks up a changed camera only on
+// a new transcode. /stream/ viewers can only move to an identical
+// transcode, so after a settings change that alters the video they are
+// disconnected and have to reconnect; the response reports how many.
+// Background tasks are restarted only if the camera's settings for them
+// changed.
+func (s *Server) handleCameraRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	cameraID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/cameras/"), "/restart")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		writeJSONError(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !s.hasFFmpeg() {
+		writeJSONError(w, "FFmpeg is not installed on this server", http.StatusNotImplemented)
+		return
+	}
+	s.log.Info("Restarting camera", "event", "camera_restart", "camera_id", cameraID, "remote_addr", r.RemoteAddr)
+
+	streams, err := s.restartStreams(cameraID, camera)
+	if err != nil {
+		s.log.Error("Failed to restart stream", "event", "stream_error", "camera_id", cameraID, "error", err)
+		writeJSONError(w, fmt.Sprintf("Failed to restart %s: %v", camera.Name, err), http.StatusBadGateway)
+		return
+	}
+	subscribers := s.restartFrameSource(cameraID, camera)
+	hls, webrtc := s.stopViewerTranscodes(cameraID)
+	tasks, err := s.updateCameraTasks(cameraID, camera, false)
+	if err != nil {
+		s.logger.Printf("Camera %s: failed to start publish, sprites or record: %v", cameraID, err)
+	}
+	if tasks == nil {
+		tasks = []string{}
+	}
+
+	status := map[string]interface{}{
+		"id":                cameraID,
+		"streams":           streams,
+		"multi_subscribers": subscribers,
+		"hls_stopped":       hls,
+		"webrtc_stopped":    webrtc,
+		"tasks_restarted":   tasks,
+		"actual_resolution": nil,
+		"codec":             nil,
+		"fps":               nil,
+		"info_updated_at":   nil,
+	}
+	if info, ok := s.streamInfo.get(cameraID); ok {
+		status["actual_resolution"] = info.Resolution
+		status["codec"] = info.Codec
+		status["fps"] = info.FPS
+		status["info_updated_at"] = info.UpdatedAt
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(status)
+}
+
+// restartStreams restarts every shared /stream/ transcode of the camera. One
+// that fails to start keeps the old transcode running for its viewers.
+func (s *Server) restartStreams(cameraID string, camera Camera) ([]restartedStream, error) {
+	s.streams.mu.Lock()
+	var qualities []string
+	for key, b := range s.streams.broadcaster {
+		if key.cameraID == cameraID && !b.isStopped() {
+			qualities = append(qualities, key.quality)
+		}
+	}
+	s.streams.mu.Unlock()
+	sort.Strings(qualities)
+
+	streams := make([]restartedStream, 0, len(qualities))
+	for _, quality := range qualities {
+		restarted, err := s.restartStream(streamKey{cameraID: cameraID, quality: quality}, camera)
+		if err != nil {
+			return nil, fmt.Errorf("%s stream: %v", quality, err)
+		}
+		streams = append(streams, restarted)
+	}
+	return streams, nil
+}
+
+// restartStream starts a new transcode for key and, once it has produced
+// its init segment, makes it the one new viewers join and hands the old
+// one's viewers over to it, so they keep the old video until then
+func (s *Server) restartStream(key streamKey, camera Camera) (restartedStream, error) {
+	restarted := restartedStream{Quality: key.quality}
+	next, err := s.startBroadcaster(key.cameraID, key.quality, camera, s.streamArgs(key.cameraID, key.quality, camera))
+	if err != nil {
+		return restarted, err
+	}
+
+	// Holds next open until the viewers have moved; leaving afterwards
+	// starts its grace period if there were none
+	probe := &streamSubscriber{ch: make(chan []byte, subscriberQueue)}
+	if _, ok := next.add(probe); !ok {
+		// FFmpeg already exited, so there is nothing to wait for
+		if cause := next.diag.diagnosis(); cause != "" {
+			return restarted, errors.New(cause)
+		}
+		return restarted, fmt.Errorf("FFmpeg exited before sending any video")
+	}
+	defer s.unsubscribe(probe)
+	if err := probe.waitForData(s.ctx, streamStartTimeout); err != nil {
+		stopFFmpeg(next.cmd)
+		if cause := next.diag.diagnosis(); cause != "" {
+			return restarted, errors.New(cause)
+		}
+		if err == errNoVideo {
+			return restarted, fmt.Errorf("no video from the camera within %v", streamStartTimeout)
+		}
+		return restarted, fmt.Errorf("FFmpeg exited before sending any video")
+	}
+
+	s.streams.mu.Lock()
+	prev := s.streams.broadcaster[key]
+	s.streams.broadcaster[key] = next
+	s.streams.mu.Unlock()
+
+	if prev != nil {
+		restarted.Viewers, restarted.Ended, restarted.FormatChanged = prev.handOff(next)
+		stopFFmpeg(prev.cmd)
+	}
+	s.logger.Printf("Restarted shared %s stream for %s: %d viewer(s) moved, %d ended", key.quality, camera.Name, restarted.Viewers, restarted.Ended)
+	return restarted, nil
+}
+
+// handOff marks b stopped and moves its viewers to next, returning how many
+// moved, how many had their stream ended instead and whether the init
+// segment changed. Their players already have b's init segment and a plain
+// <video> element can't take a second one, so only viewers of an identical
+// transcode can carry on; as with resumingStream, fragment timestamps
+// restart at zero.
+func (b *streamBroadcaster) handOff(next *streamBroadcaster) (moved, ended int, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	next.mu.Lock()
+	defer next.mu.Unlock()
+
+	b.stopped = true
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+	}
+	same := bytes.Equal(b.init, next.init)
+	changed = b.init != nil && !same
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		switch {
+		case b.init == nil:
+			// Still waiting for video, which now comes from next
+			sub.ch <- next.init
+		case !same:
+			close(sub.ch)
+			ended++
+			continue
+		}
+		next.subscribers[sub] = struct{}{}
+		sub.owner.Store(next)
+		moved++
+	}
+	if moved > 0 && next.idleTimer != nil {
+		next.idleTimer.Stop()
+		next.idleTimer = nil
+	}
+	return moved, ended, changed
+}
+
+// restartFrameSource restarts the camera's /ws/multi transcode, if it has
+// one, returning the number of sockets moved to the new one. JPEG frames
+// stand alone, so every subscriber carries on.
+func (s *Server) restartFrameSource(cameraID string, camera Camera) int {
+	s.frames.mu.Lock()
+	_, running := s.runningFrameSource(cameraID)
+	s.frames.mu.Unlock()
+	if !running {
+		return 0
+	}
+
+	args := buildMJPEGArgs(s.withCameraDefaults(camera), s.selectRTSPURL(camera), s.config.mjpegFPS())
+	next, err := s.startFrameSource(cameraID, camera, args)
+	if err != nil {
+		s.logger.Printf("Failed to restart multiplexed MJPEG for %s, keeping the running one: %v", camera.Name, err)
+		return 0
+	}
+	// As with restartStream, a subscriber that never sends starts next's
+	// grace period once the sockets have moved
+	probe := &multiSocket{}
+	next.add(probe)
+	defer s.removeFrameSocket(next, probe)
+
+	s.frames.mu.Lock()
+	prev := s.frames.sources[cameraID]
+	s.frames.sources[cameraID] = next
+	s.frames.mu.Unlock()
+
+	moved := 0
+	if prev != nil {
+		moved = prev.handOff(next)
+		stopFFmpeg(prev.cmd)
+	}
+	s.logger.Printf("Restarted multiplexed MJPEG for %s: %d socket(s) moved", camera.Name, moved)
+	return moved
+}
+
+// handOff marks f stopped and moves its sockets to next, returning how many
+// moved
+func (f *frameSource) handOff(next *frameSource) int {
+	f.mu.Lock()
+	f.stopped = true
+	if f.idleTimer != nil {
+		f.idleTimer.Stop()
+	}
+	sockets := make([]*multiSocket, 0, len(f.sockets))
+	for socket := range f.sockets {
+		delete(f.sockets, socket)
+		sockets = append(sockets, socket)
+	}
+	f.mu.Unlock()
+
+	moved := 0
+	for _, socket := range sockets {
+		// A socket that unsubscribed or closed meanwhile no longer lists f
+		socket.mu.Lock()
+		if socket.sources[f.cameraID] == f && next.add(socket) {
+			socket.sources[f.cameraID] = next
+			moved++
+		}
+		socket.mu.Unlock()
+	}
+	return moved
+}
+
+// stopViewerTranscodes stops the camera's HLS and WebRTC transcodes, which
+// can't hand their viewers over: the next HLS playlist request starts a new
+// one, and WebRTC viewers reconnect. It reports which were running.
+func (s *Server) stopViewerTranscodes(cameraID string) (hls, webrtc bool) {
+	s.hls.mu.Lock()
+	for key, session := range s.hls.sessions {
+		if key.cameraID == cameraID {
+			stopFFmpeg(session.cmd)
+			hls = true
+		}
+	}
+	s.hls.mu.Unlock()
+
+	s.webrtcSources.mu.Lock()
+	if src, ok := s.webrtcSources.sources[cameraID]; ok {
+		stopFFmpeg(src.cmd)
+		webrtc = true
+	}
+	s.webrtcSources.mu.Unlock()
+	return hls, webrtc
+}
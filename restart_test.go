@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCameraRestart restarts a camera with a viewer on its shared stream and
+// checks the viewer carries on from the new FFmpeg while the old one exits,
+// then that a restart changing the init segment ends the viewer's stream.
+// The camera's recorder is started by the first restart and left running by
+// the second, whose settings are the same.
+func TestCameraRestart(t *testing.T) {
+	ffmpeg, setMoov := fakeFFmpeg(t)
+	setMoov("AAAA")
+	s := newTestAPIServer(t, &Config{
+		FFmpegPath:    ffmpeg,
+		SkipPreflight: true,
+		Cameras: map[string]Camera{
+			"front": {
+				Name:    "Front",
+				RTSPURL: "rtsp://127.0.0.1:1/front",
+				Record:  &RecordConfig{Enabled: true, OutputDir: t.TempDir()},
+			},
+		},
+	})
+
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		resp, err := s.request(method, path, "")
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+	restart := func(wantTasks ...string) restartedStream {
+		t.Helper()
+		resp := do(http.MethodPost, "/api/cameras/front/restart")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("restart returned %d: %s", resp.StatusCode, body)
+		}
+		var status struct {
+			Streams []restartedStream `json:"streams"`
+			Tasks   []string          `json:"tasks_restarted"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("invalid restart response: %v", err)
+		}
+		if strings.Join(status.Tasks, ",") != strings.Join(wantTasks, ",") {
+			t.Errorf("restart restarted tasks %q, want %q", status.Tasks, wantTasks)
+		}
+		if len(status.Streams) != 1 {
+			t.Fatalf("restart reported %d streams, want 1", len(status.Streams))
+		}
+		return status.Streams[0]
+	}
+	current := func() *streamBroadcaster {
+		s.streams.mu.Lock()
+		defer s.streams.mu.Unlock()
+		return s.streams.broadcaster[streamKey{cameraID: "front", quality: defaultQuality}]
+	}
+
+	viewer := do(http.MethodGet, "/stream/front")
+	defer viewer.Body.Close()
+	if viewer.StatusCode != http.StatusOK {
+		t.Fatalf("stream returned %d", viewer.StatusCode)
+	}
+	// readBoxes reads n boxes of the viewer's stream, failing on an error
+	readBoxes := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, _, err := readMP4Box(viewer.Body); err != nil {
+				t.Fatalf("viewer's stream: %v", err)
+			}
+		}
+	}
+	readBoxes(4) // ftyp, moov and the first fragment
+
+	old := current()
+	if moved := restart(taskRecord); moved.Viewers != 1 || moved.Ended != 0 || moved.FormatChanged {
+		t.Errorf("restart moved %d and ended %d viewers (format changed %v), want 1 and 0", moved.Viewers, moved.Ended, moved.FormatChanged)
+	}
+	next := current()
+	if next == old {
+		t.Fatal("the old broadcaster is still current")
+	}
+	waitFor(t, func() bool {
+		_, running := s.ffmpegProcs.running()[old.cmd.Process]
+		return !running
+	})
+
+	// Fragments still arrive once the old FFmpeg has gone, and no second
+	// init segment is sent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if _, boxType, err := readMP4Box(viewer.Body); err != nil || (boxType != "moof" && boxType != "mdat") {
+				t.Errorf("after the restart, read %q: %v", boxType, err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no fragments from the new FFmpeg")
+	}
+
+	setMoov("BBBB")
+	s.cameraTasks.mu.Lock()
+	recorder := s.cameraTasks.tasks[taskKey{cameraID: "front", kind: taskRecord}]
+	s.cameraTasks.mu.Unlock()
+	if recorder == nil {
+		t.Fatal("the first restart didn't start the recorder")
+	}
+	if ended := restart(); ended.Viewers != 0 || ended.Ended != 1 || !ended.FormatChanged {
+		t.Errorf("restart moved %d and ended %d viewers (format changed %v), want 0 and 1", ended.Viewers, ended.Ended, ended.FormatChanged)
+	}
+	s.cameraTasks.mu.Lock()
+	if s.cameraTasks.tasks[taskKey{cameraID: "front", kind: taskRecord}] != recorder {
+		t.Error("the recorder was restarted though its settings are unchanged")
+	}
+	s.cameraTasks.mu.Unlock()
+	if _, err := io.Copy(io.Discard, viewer.Body); err != nil {
+		t.Errorf("viewer's stream ended with %v, want EOF", err)
+	}
+
+	resp := do(http.MethodGet, "/api/cameras/front/restart")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET restart returned %d, want 405", resp.StatusCode)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	streamRestartMin = time.Second
+	streamRestartMax = 15 * time.Second
+)
+
+// initSegment returns the ftyp+moov the broadcaster sent its viewers
+func (b *streamBroadcaster) initSegment() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.init
+}
+
+// resumingStream reads a viewer's shared stream and, when FFmpeg exits under
+// it, subscribes to a new transcode so the same response carries on. The
+// video can only continue if the new init segment is identical, and the
+// restarted fragments' timestamps begin at zero again, so some players
+// freeze at the splice; MJPEG and HLS viewers recover more cleanly.
+type resumingStream struct {
+	s          *Server
+	ctx        context.Context // The viewer's request
+	cameraID   string
+	quality    string
+	remoteAddr string
+	retries    int
+
+	mu     sync.Mutex
+	b      *streamBroadcaster
+	sub    *streamSubscriber
+	closed bool
+}
+
+func (rs *resumingStream) Read(p []byte) (int, error) {
+	for {
+		rs.mu.Lock()
+		b, sub := rs.b, rs.sub
+		rs.mu.Unlock()
+
+		n, err := sub.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if !rs.resume(b) {
+			return 0, io.EOF
+		}
+	}
+}
+
+// close detaches the current subscription and stops any further restarts
+func (rs *resumingStream) close() {
+	rs.mu.Lock()
+	rs.closed = true
+	sub := rs.sub
+	rs.mu.Unlock()
+	rs.s.unsubscribe(sub)
+}
+
+// swap makes b and sub the current subscription, unless close was called
+func (rs *resumingStream) swap(b *streamBroadcaster, sub *streamSubscriber) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return false
+	}
+	rs.b, rs.sub = b, sub
+	return true
+}
+
+// resume restarts the stream after prev ended, with backoff, reporting
+// whether the viewer has data to read again
+func (rs *resumingStream) resume(prev *streamBroadcaster) bool {
+	// A viewer detached for falling behind, or a shutdown, ends the response;
+	// only a transcode that exited under the viewer is restarted
+	if !prev.isStopped() || rs.s.ctx.Err() != nil {
+		return false
+	}
+	init := prev.initSegment()
+	backoff := streamRestartMin
+
+	for attempt := 1; attempt <= rs.retries; attempt++ {
+		rs.s.log.Warn("Stream interrupted, restarting FFmpeg", "event", "stream_restart", "camera_id", rs.cameraID, "remote_addr", rs.remoteAddr,
+			"attempt", attempt, "max_attempts", rs.retries, "backoff", backoff.String())
+		select {
+		case <-rs.ctx.Done():
+			return false
+		case <-rs.s.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > streamRestartMax {
+			backoff = streamRestartMax
+		}
+
+		camera, exists := rs.s.camera(rs.cameraID)
+		if !exists {
+			return false
+		}
+		b, sub, err := rs.s.subscribeStream(rs.cameraID, rs.quality, camera)
+		if err != nil {
+			rs.s.log.Error("Failed to restart stream", "event", "stream_error", "camera_id", rs.cameraID, "remote_addr", rs.remoteAddr, "error", err)
+			continue
+		}
+		if !rs.swap(b, sub) {
+			rs.s.unsubscribe(sub)
+			return false
+		}
+		if err := sub.waitForData(rs.ctx, streamStartTimeout); err != nil {
+			rs.s.unsubscribe(sub)
+			if rs.ctx.Err() != nil {
+				return false
+			}
+			continue
+		}
+
+		// The first chunk is the new init segment. The player already has
+		// one, so it is dropped, which only works if nothing changed.
+		if !bytes.Equal(sub.pending, init) {
+			rs.s.log.Error("Restarted stream has a different format, ending it", "event", "stream_error", "camera_id", rs.cameraID, "remote_addr", rs.remoteAddr)
+			return false
+		}
+		sub.pending = nil
+		rs.s.log.Info("Stream resumed", "event", "stream_resumed", "camera_id", rs.cameraID, "remote_addr", rs.remoteAddr, "attempt", attempt)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// monitorSlack is added to every check-in the tunnel monitor promises, to
+// cover keepalive round trips and SSH dials that run before the next one
+const monitorSlack = 2 * time.Minute
+
+// sdNotify sends state to systemd's notification socket. It is a no-op
+// when the service wasn't started by systemd with NotifyAccess.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval systemd expects WATCHDOG=1 at, or
+// 0 if WatchdogSec isn't set for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// expectMonitor records that the tunnel monitor will check in again within d
+func (s *Server) expectMonitor(d time.Duration) {
+	s.monitorDue.Store(time.Now().Add(d + monitorSlack).UnixNano())
+}
+
+// notifyReady tells systemd startup has finished and, with WatchdogSec set,
+// starts pinging its watchdog
+func (s *Server) notifyReady() {
+	status := "STATUS=Serving " + strconv.Itoa(len(s.cameraList())) + " cameras via " + s.currentTunnelMode().String() + " tunnel"
+	if err := sdNotify("READY=1\n" + status); err != nil {
+		s.logger.Printf("Warning: Could not notify systemd: %v", err)
+		return
+	}
+
+	interval := sdWatchdogInterval()
+	if interval == 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	s.logger.Printf("Pinging the systemd watchdog every %v", interval/2)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runWatchdog(interval / 2)
+	}()
+}
+
+// runWatchdog pings systemd until shutdown while the tunnel monitor keeps
+// checking in. Once it misses a check-in the pings stop, so systemd
+// restarts the service after WatchdogSec.
+func (s *Server) runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if due := time.Unix(0, s.monitorDue.Load()); now.After(due) {
+				s.log.Error("Tunnel monitor stalled, no longer pinging the systemd watchdog", "event", "watchdog_stalled",
+					"overdue", now.Sub(due).Round(time.Second).String())
+				return
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				s.logger.Printf("Warning: Could not ping the systemd watchdog: %v", err)
+			}
+		}
+	}
+}
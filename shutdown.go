@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultShutdownTimeout bounds Stop when Config.ShutdownTimeout is unset
+	defaultShutdownTimeout = 15 * time.Second
+	// forceCloseGrace is how long Stop waits after force-closing pending work
+	forceCloseGrace = 2 * time.Second
+)
+
+// workRegistry tracks in-flight connections and processes by name so Stop
+// can report and force-close whatever is still running at the deadline
+type workRegistry struct {
+	mu    sync.Mutex
+	next  int
+	items map[int]trackedWork
+}
+
+type trackedWork struct {
+	name   string
+	closer io.Closer
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// add registers work under name and returns a function that unregisters it
+func (r *workRegistry) add(name string, closer io.Closer) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.items == nil {
+		r.items = make(map[int]trackedWork)
+	}
+	id := r.next
+	r.next++
+	r.items[id] = trackedWork{name: name, closer: closer}
+
+	return func() {
+		r.mu.Lock()
+		delete(r.items, id)
+		r.mu.Unlock()
+	}
+}
+
+// closeAll closes all registered work and returns the sorted names of what was closed
+func (r *workRegistry) closeAll() []string {
+	r.mu.Lock()
+	items := make([]trackedWork, 0, len(r.items))
+	for _, item := range r.items {
+		items = append(items, item)
+	}
+	r.mu.Unlock()
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		item.closer.Close()
+		names = append(names, item.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shutdownTimeout returns the overall deadline for Stop
+func (c *Config) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout > 0 {
+		return time.Duration(c.ShutdownTimeout)
+	}
+	return defaultShutdownTimeout
+}
+
+// forceClose closes every connection and process still running so that Stop can return
+func (s *Server) forceClose() {
+	for _, name := range s.work.closeAll() {
+		s.logger.Printf("Force-closed pending %s", name)
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// ffmpegProcesses tracks every FFmpeg started by the server, whatever
+// context owns it, so Stop can wait until each one has exited and been
+// reaped by its owner
+type ffmpegProcesses struct {
+	mu    sync.Mutex
+	procs map[*os.Process]string
+}
+
+// track records a started process under name, dropping any that have
+// already been waited for
+func (p *ffmpegProcesses) track(proc *os.Process, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.procs == nil {
+		p.procs = make(map[*os.Process]string)
+	}
+	p.prune()
+	p.procs[proc] = name
+}
+
+// prune drops processes whose owners have waited for them; mu must be held.
+// A process that exited but hasn't been waited for still accepts signal 0,
+// so it is kept until it is reaped.
+func (p *ffmpegProcesses) prune() {
+	for proc := range p.procs {
+		if proc.Signal(syscall.Signal(0)) != nil {
+			delete(p.procs, proc)
+		}
+	}
+}
+
+// running returns the processes still running or not yet reaped
+func (p *ffmpegProcesses) running() map[*os.Process]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune()
+	procs := make(map[*os.Process]string, len(p.procs))
+	for proc, name := range p.procs {
+		procs[proc] = name
+	}
+	return procs
+}
+
+// startFFmpeg starts cmd and records it for Stop
+func (s *Server) startFFmpeg(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.ffmpegProcs.track(cmd.Process, strings.Join(cmd.Args, " "))
+	return nil
+}
+
+// runFFmpeg starts cmd, records it for Stop and waits for it to exit
+func (s *Server) runFFmpeg(cmd *exec.Cmd) error {
+	if err := s.startFFmpeg(cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// stopFFmpegProcesses sends SIGTERM to every FFmpeg still running and waits
+// until deadline for their owners to reap them, killing what is left then
+func (s *Server) stopFFmpegProcesses(deadline time.Time) {
+	procs := s.ffmpegProcs.running()
+	if len(procs) == 0 {
+		return
+	}
+	s.logger.Printf("Waiting for %d FFmpeg process(es) to exit", len(procs))
+	for proc := range procs {
+		proc.Signal(syscall.SIGTERM)
+	}
+
+	killed := false
+	for {
+		procs = s.ffmpegProcs.running()
+		if len(procs) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			if killed {
+				for proc, name := range procs {
+					s.logger.Printf("FFmpeg process %d did not exit: %s", proc.Pid, redactCredentials(name))
+				}
+				return
+			}
+			for proc := range procs {
+				proc.Kill()
+			}
+			killed = true
+			deadline = time.Now().Add(forceCloseGrace)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStopReapsFFmpeg starts stand-ins for FFmpeg through the registry,
+// one of them ignoring SIGTERM, and checks that none of their PIDs is left
+// once Stop returns
+func TestStopReapsFFmpeg(t *testing.T) {
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	// Ignored signals stay ignored across exec, so "stubborn" only dies to SIGKILL
+	script := "#!/bin/sh\nif [ \"$1\" = stubborn ]; then trap '' TERM; fi\nexec sleep 30\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(&Config{FFmpegPath: ffmpeg, ShutdownTimeout: Duration(500 * time.Millisecond)})
+	s.logger.SetOutput(&syncBuffer{})
+
+	var pids []int
+	start := func(ctx context.Context, args ...string) {
+		cmd := s.ffmpegCommand(ctx, args...)
+		if err := s.startFFmpeg(cmd); err != nil {
+			t.Fatalf("startFFmpeg: %v", err)
+		}
+		pids = append(pids, cmd.Process.Pid)
+		// Owners reap their own process, as the stream and task goroutines do
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			cmd.Wait()
+		}()
+	}
+	start(s.ctx, "stream")
+	// Snapshots and previews run on request contexts Stop doesn't cancel
+	start(context.Background(), "snapshot")
+	start(context.Background(), "stubborn")
+
+	// Let the shell reach trap before Stop signals it
+	time.Sleep(100 * time.Millisecond)
+	begin := time.Now()
+	s.Stop()
+	if limit := time.Duration(s.config.ShutdownTimeout) + forceCloseGrace; time.Since(begin) > limit {
+		t.Errorf("Stop took %v, want at most %v", time.Since(begin), limit)
+	}
+
+	for _, pid := range pids {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+			t.Errorf("FFmpeg process %d is still there after Stop", pid)
+		}
+	}
+	if running := s.ffmpegProcs.running(); len(running) > 0 {
+		t.Errorf("%d process(es) still registered after Stop", len(running))
+	}
+}
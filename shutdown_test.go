@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStopWithStuckConnection checks that Stop returns by the shutdown
+// deadline when a handler never returns, and logs the work it gave up on
+func TestStopWithStuckConnection(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// handler blocks until release is closed, registering its work with s
+		handler func(s *Server, started chan<- struct{}, release <-chan struct{}) http.HandlerFunc
+		// limit is how long Stop may take
+		limit    time.Duration
+		wantLogs []string
+	}{
+		{
+			name: "blocked handler",
+			handler: func(s *Server, started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					// The closer doesn't unblock the handler, as with a
+					// write stuck on a client that stopped reading
+					unregister := s.work.add("stuck stream for "+r.RemoteAddr, closerFunc(func() error { return nil }))
+					defer unregister()
+					close(started)
+					<-release
+				}
+			},
+			limit:    timeout + time.Second,
+			wantLogs: []string{"HTTP server did not drain before shutdown timeout", "Force-closed pending stuck stream for"},
+		},
+		{
+			name: "hijacked connection",
+			handler: func(s *Server, started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						t.Errorf("Hijack: %v", err)
+						return
+					}
+					// Shutdown doesn't track hijacked connections, so only
+					// the wait group holds Stop up
+					s.wg.Add(1)
+					unregister := s.work.add("hijacked connection from "+r.RemoteAddr, closerFunc(func() error { return nil }))
+					go func() {
+						defer s.wg.Done()
+						defer unregister()
+						defer conn.Close()
+						<-release
+					}()
+					close(started)
+				}
+			},
+			limit:    timeout + forceCloseGrace + time.Second,
+			wantLogs: []string{"Shutdown timeout reached, force-closing pending work", "Force-closed pending hijacked connection from", "Some goroutines did not exit after force-close"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(&Config{ShutdownTimeout: Duration(timeout)})
+			var logs syncBuffer
+			s.logger.SetOutput(&logs)
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			defer close(release)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.httpServer = &http.Server{Handler: tt.handler(s, started, release)}
+			go s.httpServer.Serve(listener)
+
+			go func() {
+				resp, err := http.Get("http://" + listener.Addr().String() + "/")
+				if err == nil {
+					resp.Body.Close()
+				}
+			}()
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("request never reached the handler")
+			}
+
+			begin := time.Now()
+			s.Stop()
+			if elapsed := time.Since(begin); elapsed > tt.limit {
+				t.Errorf("Stop took %v, want at most %v", elapsed, tt.limit)
+			}
+
+			output := logs.String()
+			for _, want := range append(tt.wantLogs, "Server stopped") {
+				if !strings.Contains(output, want) {
+					t.Errorf("log is missing %q:\n%s", want, output)
+				}
+			}
+		})
+	}
+}
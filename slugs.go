@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// slugPattern restricts slugs to lowercase URL-friendly words joined by hyphens
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// buildSlugIndex maps each camera slug to its ID, reporting every invalid or
+// colliding slug. A slug may not repeat another slug or shadow a camera ID.
+func buildSlugIndex(cameras map[string]Camera) (map[string]string, error) {
+	index := make(map[string]string)
+	var problems []string
+
+	ids := make([]string, 0, len(cameras))
+	for id := range cameras {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		slug := cameras[id].Slug
+		if slug == "" {
+			continue
+		}
+		if !slugPattern.MatchString(slug) {
+			problems = append(problems, fmt.Sprintf("camera %s: slug %q must be lowercase letters, digits and hyphens", id, slug))
+			continue
+		}
+		if other, taken := index[slug]; taken {
+			problems = append(problems, fmt.Sprintf("camera %s: slug %q is already used by camera %s", id, slug, other))
+			continue
+		}
+		if _, isID := cameras[slug]; isID && slug != id {
+			problems = append(problems, fmt.Sprintf("camera %s: slug %q collides with another camera's ID", id, slug))
+			continue
+		}
+		index[slug] = id
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid camera slugs: %s", strings.Join(problems, "; "))
+	}
+	return index, nil
+}
+
+// lookupCamera resolves a camera by ID or slug and returns its ID
+func (s *Server) lookupCamera(key string) (string, Camera, bool) {
+	s.camerasMu.RLock()
+	defer s.camerasMu.RUnlock()
+
+	if camera, exists := s.config.Cameras[key]; exists {
+		return key, camera, true
+	}
+	if id, exists := s.slugs[key]; exists {
+		camera, exists := s.config.Cameras[id]
+		return id, camera, exists
+	}
+	return "", Camera{}, false
+}
+
+// viewerPath returns the viewer URL for a camera, preferring its slug
+func viewerPath(id string, camera Camera) string {
+	if camera.Slug != "" {
+		return "/camera/" + camera.Slug
+	}
+	return "/camera/" + id
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSnapshotTimeout = 10 * time.Second
+	maxSnapshotWidth       = 3840
+)
+
+// snapshotTimeout returns how long a snapshot capture may take
+func (c *Config) snapshotTimeout() time.Duration {
+	if c.SnapshotTimeout > 0 {
+		return time.Duration(c.SnapshotTimeout)
+	}
+	return defaultSnapshotTimeout
+}
+
+// buildSnapshotArgs returns FFmpeg args that grab a single JPEG frame,
+// scaled to width when it is non-zero
+func buildSnapshotArgs(camera Camera, rtspURL string, width int) []string {
+	args := camera.rtspInputArgs()
+	args = append(args, camera.probeArgs()...)
+	args = append(args, "-i", rtspURL)
+
+	var scale string
+	if width > 0 {
+		scale = fmt.Sprintf("scale=%d:-2", width)
+	}
+	if chain := camera.withVideoFilters(scale); chain != "" {
+		args = append(args, "-vf", chain)
+	}
+	return append(args,
+		"-frames:v", "1",
+		"-an",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1",
+	)
+}
+
+func (s *Server) handleCameraSnapshot(w http.ResponseWriter, r *http.Request) {
+	cameraID := strings.TrimPrefix(r.URL.Path, "/snapshot/")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+
+	width := 0
+	if v := r.URL.Query().Get("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 16 || n > maxSnapshotWidth {
+			http.Error(w, fmt.Sprintf("width must be between 16 and %d", maxSnapshotWidth), http.StatusBadRequest)
+			return
+		}
+		width = n
+	}
+
+	if !s.captures.acquire(s.config.maxCaptures()) {
+		s.logger.Printf("Capture limit of %d reached, rejecting snapshot for %s", s.config.maxCaptures(), camera.Name)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many captures in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.captures.release()
+
+	// The context kills FFmpeg if the camera doesn't deliver a frame in time
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.snapshotTimeout())
+	defer cancel()
+
+	cmd := s.ffmpegCommand(ctx, buildSnapshotArgs(s.withCameraDefaults(camera), s.selectRTSPURL(camera), width)...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := s.runFFmpeg(cmd)
+	output := stdout.Bytes()
+	if ctx.Err() == context.DeadlineExceeded {
+		s.logger.Printf("Snapshot for %s timed out after %v", camera.Name, s.config.snapshotTimeout())
+		http.Error(w, "Timed out waiting for a frame", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil || len(output) == 0 {
+		s.logger.Printf("Failed to capture snapshot for %s: %v", camera.Name, err)
+		http.Error(w, "Failed to capture snapshot", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	w.Write(output)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSpriteDir       = "sprites"
+	defaultSpriteInterval  = 10 * time.Second
+	defaultSpriteColumns   = 5
+	defaultSpriteRows      = 5
+	defaultSpriteWidth     = 160
+	defaultSpriteRetention = 24 * time.Hour
+	spriteIndexFile        = "index.json"
+)
+
+// SpriteConfig enables periodic thumbnail capture assembled into sprite sheets
+type SpriteConfig struct {
+	Interval  Duration `json:"interval,omitempty"`  // Time between thumbnails, defaults to 10s
+	Columns   int      `json:"columns,omitempty"`   // Defaults to 5
+	Rows      int      `json:"rows,omitempty"`      // Defaults to 5
+	Width     int      `json:"width,omitempty"`     // Thumbnail width in pixels, defaults to 160 (16:9 tiles)
+	Retention Duration `json:"retention,omitempty"` // How long sheets are kept, defaults to 24h
+}
+
+// SpriteSheet describes one sprite image in a camera's index
+type SpriteSheet struct {
+	File       string      `json:"file"`
+	URL        string      `json:"url"`
+	Columns    int         `json:"columns"`
+	Rows       int         `json:"rows"`
+	TileWidth  int         `json:"tile_width"`
+	TileHeight int         `json:"tile_height"`
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	Timestamps []time.Time `json:"timestamps"` // One per tile, row-major
+}
+
+// SpriteIndex lists a camera's sprite sheets, oldest first
+type SpriteIndex struct {
+	CameraID string        `json:"camera_id"`
+	Sheets   []SpriteSheet `json:"sheets"`
+}
+
+// spriteSettings fills in defaults for unset fields
+func (c SpriteConfig) spriteSettings() SpriteConfig {
+	if c.Interval <= 0 {
+		c.Interval = Duration(defaultSpriteInterval)
+	}
+	if c.Columns <= 0 {
+		c.Columns = defaultSpriteColumns
+	}
+	if c.Rows <= 0 {
+		c.Rows = defaultSpriteRows
+	}
+	if c.Width <= 0 {
+		c.Width = defaultSpriteWidth
+	}
+	if c.Retention <= 0 {
+		c.Retention = Duration(defaultSpriteRetention)
+	}
+	return c
+}
+
+// tileHeight returns the 16:9 height for the configured tile width, rounded to even
+func (c SpriteConfig) tileHeight() int {
+	return (c.Width * 9 / 16) &^ 1
+}
+
+// spriteCameraDir returns the directory holding cameraID's sprites
+func (s *Server) spriteCameraDir(cameraID string) string {
+	root := s.config.SpriteDir
+	if root == "" {
+		root = defaultSpriteDir
+	}
+	return filepath.Join(s.expandPath(root), cameraID)
+}
+
+// startSpriteTask starts the camera's sprite capture as part of task, if
+// Sprites is configured
+func (s *Server) startSpriteTask(task *cameraTask, cameraID string, camera Camera) error {
+	if camera.Sprites == nil {
+		return nil
+	}
+	dir := s.spriteCameraDir(cameraID)
+	if err := os.MkdirAll(filepath.Join(dir, ".frames"), 0755); err != nil {
+		return fmt.Errorf("camera %s: failed to create sprite directory: %v", cameraID, err)
+	}
+
+	s.goTask(task, func() {
+		s.runSpriteTask(task.ctx, cameraID, camera, camera.Sprites.spriteSettings())
+	})
+	return nil
+}
+
+// runSpriteTask captures a thumbnail every interval and composites a sheet
+// each time enough tiles have been collected, until ctx is cancelled
+func (s *Server) runSpriteTask(ctx context.Context, cameraID string, camera Camera, cfg SpriteConfig) {
+	dir := s.spriteCameraDir(cameraID)
+	framesDir := filepath.Join(dir, ".frames")
+	perSheet := cfg.Columns * cfg.Rows
+
+	// Frames from an interrupted sheet have no recorded timestamps
+	os.RemoveAll(framesDir)
+	os.MkdirAll(framesDir, 0755)
+
+	s.logger.Printf("Sprite capture for %s every %v (%dx%d per sheet)", camera.Name, time.Duration(cfg.Interval), cfg.Columns, cfg.Rows)
+
+	ticker := time.NewTicker(time.Duration(cfg.Interval))
+	defer ticker.Stop()
+
+	var timestamps []time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.captures.acquire(s.config.maxCaptures()) {
+			// Skip this tick rather than queueing behind previews
+			continue
+		}
+		frame := filepath.Join(framesDir, fmt.Sprintf("frame_%03d.jpg", len(timestamps)))
+		capturedAt := time.Now()
+		err := s.captureThumbnail(ctx, camera, frame, cfg)
+		s.captures.release()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Printf("Sprite capture for %s failed: %v", camera.Name, err)
+			}
+			continue
+		}
+
+		timestamps = append(timestamps, capturedAt)
+		if len(timestamps) < perSheet {
+			continue
+		}
+
+		if err := s.composeSpriteSheet(ctx, cameraID, cfg, timestamps); err != nil {
+			s.logger.Printf("Failed to build sprite sheet for %s: %v", camera.Name, err)
+		}
+		timestamps = timestamps[:0]
+		os.RemoveAll(framesDir)
+		os.MkdirAll(framesDir, 0755)
+	}
+}
+
+// thumbnailArgs builds the FFmpeg arguments that grab one frame from
+// rtspURL and write it to path as a tile of cfg's size
+func thumbnailArgs(camera Camera, rtspURL, path string, cfg SpriteConfig) []string {
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2",
+		cfg.Width, cfg.tileHeight(), cfg.Width, cfg.tileHeight())
+
+	args := append([]string{"-y"}, camera.rtspInputArgs()...)
+	args = append(args, camera.probeArgs()...)
+	return append(args,
+		"-i", rtspURL,
+		"-frames:v", "1",
+		"-vf", camera.withVideoFilters(scale),
+		"-q:v", "5",
+		"-f", "image2",
+		path,
+	)
+}
+
+// captureThumbnail writes one scaled still from the camera to path
+func (s *Server) captureThumbnail(ctx context.Context, camera Camera, path string, cfg SpriteConfig) error {
+	camera = s.withCameraDefaults(camera)
+	cmd := s.ffmpegCommand(ctx, thumbnailArgs(camera, s.selectRTSPURL(camera), path, cfg)...)
+	done := make(chan error, 1)
+	if err := s.startFFmpeg(cmd); err != nil {
+		return err
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(20 * time.Second):
+		stopFFmpeg(cmd)
+		<-done
+		return fmt.Errorf("timed out waiting for a frame")
+	}
+}
+
+// composeSpriteSheet tiles the collected frames into one image, adds it to
+// the index and prunes sheets older than the retention period
+func (s *Server) composeSpriteSheet(ctx context.Context, cameraID string, cfg SpriteConfig, timestamps []time.Time) error {
+	dir := s.spriteCameraDir(cameraID)
+	name := "sprite_" + timestamps[0].UTC().Format("20060102T150405Z") + ".jpg"
+
+	cmd := s.ffmpegCommand(ctx,
+		"-y",
+		"-framerate", "1",
+		"-i", filepath.Join(dir, ".frames", "frame_%03d.jpg"),
+		"-vf", fmt.Sprintf("tile=%dx%d", cfg.Columns, cfg.Rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		filepath.Join(dir, name),
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := s.runFFmpeg(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, lastLine(output.String()))
+	}
+
+	index := s.readSpriteIndex(cameraID)
+	index.Sheets = append(index.Sheets, SpriteSheet{
+		File:       name,
+		URL:        fmt.Sprintf("/sprites/%s/%s", cameraID, name),
+		Columns:    cfg.Columns,
+		Rows:       cfg.Rows,
+		TileWidth:  cfg.Width,
+		TileHeight: cfg.tileHeight(),
+		Start:      timestamps[0],
+		End:        timestamps[len(timestamps)-1],
+		Timestamps: append([]time.Time(nil), timestamps...),
+	})
+
+	// Retention
+	cutoff := time.Now().Add(-time.Duration(cfg.Retention))
+	kept := index.Sheets[:0]
+	for _, sheet := range index.Sheets {
+		if sheet.End.Before(cutoff) {
+			os.Remove(filepath.Join(dir, sheet.File))
+			continue
+		}
+		kept = append(kept, sheet)
+	}
+	index.Sheets = kept
+
+	return writeSpriteIndex(dir, index)
+}
+
+// readSpriteIndex loads a camera's sprite index, returning an empty one if none exists
+func (s *Server) readSpriteIndex(cameraID string) *SpriteIndex {
+	index := &SpriteIndex{CameraID: cameraID, Sheets: []SpriteSheet{}}
+	data, err := os.ReadFile(filepath.Join(s.spriteCameraDir(cameraID), spriteIndexFile))
+	if err != nil {
+		return index
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		s.logger.Printf("Ignoring corrupt sprite index for %s: %v", cameraID, err)
+		return &SpriteIndex{CameraID: cameraID, Sheets: []SpriteSheet{}}
+	}
+	return index
+}
+
+// writeSpriteIndex replaces the index atomically so readers never see a partial file
+func writeSpriteIndex(dir string, index *SpriteIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, spriteIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, spriteIndexFile))
+}
+
+// handleSprites serves /sprites/{id}/index.json and the sheet images it lists
+func (s *Server) handleSprites(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/sprites/"), "/", 2)
+	cameraID := parts[0]
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		http.Error(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		http.Error(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+	if camera.Sprites == nil || len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := parts[1]
+	switch {
+	case file == spriteIndexFile:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(s.readSpriteIndex(cameraID))
+	case strings.HasPrefix(file, "sprite_") && strings.HasSuffix(file, ".jpg") && filepath.Base(file) == file:
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(defaultSpriteRetention.Seconds())))
+		http.ServeFile(w, r, filepath.Join(s.spriteCameraDir(cameraID), file))
+	default:
+		http.NotFound(w, r)
+	}
+}
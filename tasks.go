@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// cameraTask is one publish, record or sprite job of a camera, which runs
+// FFmpeg without a viewer. It is cancelled when the camera is removed or
+// the job's settings change.
+type cameraTask struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+	// signature is the FFmpeg invocation and settings the task was started
+	// with; a task whose signature is unchanged is left running
+	signature string
+}
+
+// Kinds of camera task, in the order they are started
+const (
+	taskPublish = "publish"
+	taskSprites = "sprites"
+	taskRecord  = "record"
+)
+
+var taskKinds = []string{taskPublish, taskSprites, taskRecord}
+
+// taskKey identifies one task of a camera
+type taskKey struct {
+	cameraID string
+	kind     string
+}
+
+// cameraTasks tracks the running tasks of each camera
+type cameraTasks struct {
+	mu    sync.Mutex
+	tasks map[taskKey]*cameraTask
+}
+
+// goTask runs fn as part of task, counted in s.wg so Stop waits for it too
+func (s *Server) goTask(task *cameraTask, fn func()) {
+	task.done.Add(1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer task.done.Done()
+		fn()
+	}()
+}
+
+// runsInBackground reports whether the camera publishes, records or builds
+// sprite sheets
+func (c Camera) runsInBackground() bool {
+	return c.Publish != nil || c.Sprites != nil || (c.Record != nil && c.Record.Enabled)
+}
+
+// startCameraTasks starts the camera's publisher, recorder and sprite task,
+// replacing any already running for cameraID. Nothing is left running if one
+// of them fails to start.
+func (s *Server) startCameraTasks(cameraID string, camera Camera) error {
+	_, err := s.updateCameraTasks(cameraID, camera, true)
+	return err
+}
+
+// updateCameraTasks brings the camera's tasks in line with camera: tasks it
+// no longer configures are stopped, new ones started, and those whose
+// signature changed restarted, while the rest keep running so a recording
+// isn't split needlessly. With all set every task is restarted. It returns
+// the kinds started, stopped or restarted. Nothing is left running if one
+// fails to start.
+func (s *Server) updateCameraTasks(cameraID string, camera Camera, all bool) ([]string, error) {
+	// While idle they are started by resumeFromIdle instead
+	if !s.hasFFmpeg() || s.quiesced.Load() {
+		s.stopCameraTasks(cameraID)
+		return nil, nil
+	}
+
+	var changed []string
+	for _, kind := range taskKinds {
+		key := taskKey{cameraID: cameraID, kind: kind}
+		signature, configured := s.taskSignature(cameraID, kind, camera)
+		s.cameraTasks.mu.Lock()
+		running := s.cameraTasks.tasks[key]
+		s.cameraTasks.mu.Unlock()
+		if running == nil && !configured {
+			continue
+		}
+		if running != nil && configured && running.signature == signature && !all {
+			continue
+		}
+
+		changed = append(changed, kind)
+		s.stopTask(key)
+		if !configured {
+			continue
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		task := &cameraTask{ctx: ctx, cancel: cancel, signature: signature}
+		if err := s.startTask(task, cameraID, kind, camera); err != nil {
+			cancel()
+			task.done.Wait()
+			s.stopCameraTasks(cameraID)
+			s.publishers.remove(cameraID)
+			return changed, err
+		}
+
+		s.cameraTasks.mu.Lock()
+		if s.cameraTasks.tasks == nil {
+			s.cameraTasks.tasks = make(map[taskKey]*cameraTask)
+		}
+		raced := s.cameraTasks.tasks[key]
+		s.cameraTasks.tasks[key] = task
+		s.cameraTasks.mu.Unlock()
+
+		// Another start for the same camera finished in the meantime
+		if raced != nil {
+			raced.cancel()
+			raced.done.Wait()
+		}
+	}
+	return changed, nil
+}
+
+// startTask starts the kind of task for the camera as part of task
+func (s *Server) startTask(task *cameraTask, cameraID, kind string, camera Camera) error {
+	switch kind {
+	case taskPublish:
+		return s.startPublisher(task, cameraID, camera)
+	case taskSprites:
+		return s.startSpriteTask(task, cameraID, camera)
+	default:
+		return s.startRecorder(task, cameraID, camera)
+	}
+}
+
+// taskSignature returns what the kind of task runs for the camera, its
+// FFmpeg arguments with every RTSP URL it may pick and the task's own
+// settings, and whether the camera configures that task at all
+func (s *Server) taskSignature(cameraID, kind string, camera Camera) (string, bool) {
+	withDefaults := s.withCameraDefaults(camera)
+	urls := strings.Join(camera.rtspURLs(), " ")
+	var args []string
+	switch kind {
+	case taskPublish:
+		if camera.Publish == nil {
+			return "", false
+		}
+		format, err := camera.Publish.publishFormat()
+		if err != nil {
+			// Fails to start either way
+			return err.Error(), true
+		}
+		args = buildPublishArgs(withDefaults, urls, format)
+	case taskSprites:
+		if camera.Sprites == nil {
+			return "", false
+		}
+		cfg := camera.Sprites.spriteSettings()
+		args = append(thumbnailArgs(withDefaults, urls, s.spriteCameraDir(cameraID), cfg), fmt.Sprintf("%+v", cfg))
+	default:
+		if camera.Record == nil || !camera.Record.Enabled {
+			return "", false
+		}
+		cfg := withDefaults.Record
+		args = append(buildRecordArgs(withDefaults, urls, s.recordDir(cameraID, cfg), cfg.segmentLength()), fmt.Sprintf("%+v", *cfg))
+	}
+	return strings.Join(args, " "), true
+}
+
+// startAllCameraTasks starts the background tasks of every configured camera
+func (s *Server) startAllCameraTasks() error {
+	for cameraID, camera := range s.cameraList() {
+		if err := s.startCameraTasks(cameraID, camera); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ids returns the cameras with background tasks running
+func (t *cameraTasks) ids() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[string]bool)
+	var ids []string
+	for key := range t.tasks {
+		if !seen[key.cameraID] {
+			seen[key.cameraID] = true
+			ids = append(ids, key.cameraID)
+		}
+	}
+	return ids
+}
+
+// stopCameraTasks cancels the camera's background tasks and waits for their
+// FFmpeg processes to exit, reporting whether any were running
+func (s *Server) stopCameraTasks(cameraID string) bool {
+	stopped := false
+	for _, kind := range taskKinds {
+		if s.stopTask(taskKey{cameraID: cameraID, kind: kind}) {
+			stopped = true
+		}
+	}
+	return stopped
+}
+
+// stopTask cancels one task and waits for its FFmpeg to exit, reporting
+// whether it was running
+func (s *Server) stopTask(key taskKey) bool {
+	s.cameraTasks.mu.Lock()
+	task, ok := s.cameraTasks.tasks[key]
+	delete(s.cameraTasks.tasks, key)
+	s.cameraTasks.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	task.cancel()
+	task.done.Wait()
+	if key.kind == taskPublish {
+		s.publishers.remove(key.cameraID)
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// tlsEnabled reports whether the HTTP server should serve HTTPS
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCertPath != "" || c.TLSKeyPath != "" || c.TLSAutoCert
+}
+
+// scheme returns the URL scheme viewers use to reach the server
+func (c *Config) scheme() string {
+	if c.tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// loadTLSConfig builds the server TLS config from the configured certificate
+// files, falling back to a generated self-signed certificate when
+// TLSAutoCert is set and the files don't exist. Returns nil if TLS is off.
+func (s *Server) loadTLSConfig() (*tls.Config, error) {
+	if !s.config.tlsEnabled() {
+		return nil, nil
+	}
+	if (s.config.TLSCertPath == "") != (s.config.TLSKeyPath == "") {
+		return nil, fmt.Errorf("tls_cert_path and tls_key_path must be set together")
+	}
+
+	certPath := s.expandPath(s.config.TLSCertPath)
+	keyPath := s.expandPath(s.config.TLSKeyPath)
+
+	if certPath != "" && (fileExists(certPath) || !s.config.TLSAutoCert) {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		s.logger.Printf("Loaded TLS certificate from %s", certPath)
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	cert, err := generateSelfSignedCert(s.config.VPSHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+	}
+	s.logger.Println("WARNING: Using a generated self-signed TLS certificate, browsers will show a warning")
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// generateSelfSignedCert creates an in-memory certificate for host, localhost and the loopback addresses
+func generateSelfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"camera-tunnel"}, CommonName: host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if host != "" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrafficClients caps the per-client totals kept for /api/stats; the
+// client seen least recently is dropped to make room
+const maxTrafficClients = 256
+
+// clientTraffic is one client's tunnel byte totals
+type clientTraffic struct {
+	Client      string    `json:"client"`
+	Connections int64     `json:"connections"`
+	BytesSent   int64     `json:"bytes_sent"`
+	BytesRecv   int64     `json:"bytes_received"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// tunnelTraffic totals the bytes forwarded through the tunnel since startup.
+// Sent is towards the remote client, received is from it.
+type tunnelTraffic struct {
+	connections atomic.Int64
+	sent        atomic.Int64
+	recv        atomic.Int64
+
+	mu      sync.Mutex
+	clients map[string]*clientTraffic
+}
+
+// record adds a finished connection's byte counts
+func (t *tunnelTraffic) record(remoteAddr string, sent, recv int64) {
+	t.connections.Add(1)
+	t.sent.Add(sent)
+	t.recv.Add(recv)
+
+	client := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		client = host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[string]*clientTraffic)
+	}
+	entry, ok := t.clients[client]
+	if !ok {
+		if len(t.clients) >= maxTrafficClients {
+			t.evictOldest()
+		}
+		entry = &clientTraffic{Client: client}
+		t.clients[client] = entry
+	}
+	entry.Connections++
+	entry.BytesSent += sent
+	entry.BytesRecv += recv
+	entry.LastSeen = time.Now()
+}
+
+// evictOldest drops the client seen least recently; mu must be held
+func (t *tunnelTraffic) evictOldest() {
+	var oldest string
+	for client, entry := range t.clients {
+		if oldest == "" || entry.LastSeen.Before(t.clients[oldest].LastSeen) {
+			oldest = client
+		}
+	}
+	delete(t.clients, oldest)
+}
+
+// topClients returns every client's totals, heaviest first
+func (t *tunnelTraffic) topClients() []clientTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clients := make([]clientTraffic, 0, len(t.clients))
+	for _, entry := range t.clients {
+		clients = append(clients, *entry)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].BytesSent+clients[i].BytesRecv > clients[j].BytesSent+clients[j].BytesRecv
+	})
+	return clients
+}
+
+// handleStats serves tunnel traffic totals, per client and per camera
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	cameras := make(map[string]int64)
+	for cameraID := range s.cameraList() {
+		cameras[cameraID] = 0
+	}
+	s.metrics.mu.Lock()
+	for cameraID, n := range s.metrics.bytesStreamed {
+		cameras[cameraID] = n
+	}
+	s.metrics.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"tunnel": map[string]int64{
+			"connections":    s.traffic.connections.Load(),
+			"bytes_sent":     s.traffic.sent.Load(),
+			"bytes_received": s.traffic.recv.Load(),
+		},
+		"clients":               s.traffic.topClients(),
+		"camera_bytes_streamed": cameras,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(stats)
+}
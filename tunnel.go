@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshTunnel is one Go SSH connection to the VPS together with its remote
+// listeners and their accept loops. Every connect or reconnect builds a new
+// one, and the one it replaces is closed first, so accept loops never
+// outlive their connection.
+type sshTunnel struct {
+	client    *ssh.Client
+	ctx       context.Context // Cancelled when the tunnel is closed, stops its accept loops
+	cancel    context.CancelFunc
+	accepting sync.WaitGroup
+}
+
+// newTunnel wraps client, which is closed along with the tunnel
+func (s *Server) newTunnel(client *ssh.Client) *sshTunnel {
+	ctx, cancel := context.WithCancel(s.ctx)
+	return &sshTunnel{client: client, ctx: ctx, cancel: cancel}
+}
+
+// serve starts an accept loop for each of the forward's listeners
+func (s *Server) serve(t *sshTunnel, listeners []net.Listener, localAddr string, stat *forwardStat) {
+	for _, listener := range listeners {
+		t.accepting.Add(1)
+		s.wg.Add(1)
+		go func(listener net.Listener) {
+			defer s.wg.Done()
+			defer t.accepting.Done()
+			s.acceptTunnel(t, listener, localAddr, stat)
+		}(listener)
+	}
+}
+
+// stop cancels the accept loops and closes the SSH connection without
+// waiting. Closing the connection first makes Accept return at once and
+// keeps closing the listeners from waiting on a VPS that stopped answering.
+func (t *sshTunnel) stop() {
+	t.cancel()
+	t.client.Close()
+}
+
+// close stops the tunnel and waits for its accept loops to return. It may be
+// called more than once.
+func (t *sshTunnel) close() {
+	t.stop()
+	t.accepting.Wait()
+}
+
+// currentTunnel returns the Go SSH tunnel, or nil before the first connect
+// and while the tunnel is down for idle shutdown
+func (s *Server) currentTunnel() *sshTunnel {
+	return s.tunnel.Load()
+}
+
+// currentTunnelMode returns which tunnel Start established
+func (s *Server) currentTunnelMode() tunnelMode {
+	return tunnelMode(s.tunnelMethod.Load())
+}
+
+func (s *Server) setTunnelMode(m tunnelMode) {
+	s.tunnelMethod.Store(int32(m))
+}
+
+// replaceTunnel makes t the current tunnel, returning the one it replaces
+func (s *Server) replaceTunnel(t *sshTunnel) *sshTunnel {
+	return s.tunnel.Swap(t)
+}
+
+// closeTunnel closes the current tunnel, if any, and waits for its accept
+// loops. Only the tunnel monitor and Start call it, as the owners of the
+// tunnel.
+func (s *Server) closeTunnel() {
+	if t := s.replaceTunnel(nil); t != nil {
+		t.close()
+	}
+}
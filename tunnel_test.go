@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeVPS is an SSH server that binds remote forwards on loopback, refusing
+// the ports in refuse the way sshd does when they are taken. Like a stock
+// sshd it has both an ed25519 and an ECDSA host key; hostKey is the ed25519
+// one.
+type fakeVPS struct {
+	t        *testing.T
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	refuse   map[uint32]bool
+
+	mu        sync.Mutex
+	forwards  map[uint32]net.Listener
+	connected int
+}
+
+func newFakeVPS(t *testing.T, password string, refuse ...int) *fakeVPS {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if string(given) != password {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaSigner, err := ssh.NewSignerFromKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(ecdsaSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &fakeVPS{t: t, listener: listener, config: config, hostKey: signer.PublicKey(), refuse: make(map[uint32]bool), forwards: make(map[uint32]net.Listener)}
+	for _, port := range refuse {
+		v.refuse[uint32(port)] = true
+	}
+	go v.serve()
+	t.Cleanup(func() { listener.Close() })
+	return v
+}
+
+func (v *fakeVPS) port() int {
+	return v.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (v *fakeVPS) serve() {
+	for {
+		conn, err := v.listener.Accept()
+		if err != nil {
+			return
+		}
+		go v.handle(conn)
+	}
+}
+
+func (v *fakeVPS) handle(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, v.config)
+	if err != nil {
+		return
+	}
+	v.mu.Lock()
+	v.connected++
+	v.mu.Unlock()
+
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "no channels on the fake VPS")
+		}
+	}()
+
+	owned := make(map[uint32]bool)
+	for req := range reqs {
+		var fwd struct {
+			Addr string
+			Port uint32
+		}
+		if err := ssh.Unmarshal(req.Payload, &fwd); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		switch req.Type {
+		case "tcpip-forward":
+			if v.refuse[fwd.Port] || strings.Contains(fwd.Addr, ":") {
+				req.Reply(false, nil)
+				continue
+			}
+			listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(fwd.Port)))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			v.mu.Lock()
+			v.forwards[fwd.Port] = listener
+			v.mu.Unlock()
+			owned[fwd.Port] = true
+			req.Reply(true, ssh.Marshal(struct{ Port uint32 }{fwd.Port}))
+		case "cancel-tcpip-forward":
+			v.closeForward(fwd.Port)
+			delete(owned, fwd.Port)
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+
+	// Like sshd, drop the connection's forwards when it closes
+	for port := range owned {
+		v.closeForward(port)
+	}
+	sshConn.Close()
+	v.mu.Lock()
+	v.connected--
+	v.mu.Unlock()
+}
+
+func (v *fakeVPS) closeForward(port uint32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if listener, ok := v.forwards[port]; ok {
+		listener.Close()
+		delete(v.forwards, port)
+	}
+}
+
+// state returns the number of bound forwards and connected clients
+func (v *fakeVPS) state() (forwards, connected int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.forwards), v.connected
+}
+
+// freePort returns a loopback port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// TestKnownHostsPinsKeyType checks that a VPS recorded only by its ed25519
+// key is asked for that key although it also offers ECDSA, and that with
+// trust_on_first_use a key of another type is learned rather than reported
+// as changed
+func TestKnownHostsPinsKeyType(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	vps := newFakeVPS(t, "hunter2")
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(vps.port()))
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	entry := knownhosts.Line([]string{knownhosts.Normalize(addr)}, vps.hostKey) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(entry), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(&Config{
+		VPSHost:        "127.0.0.1",
+		VPSPort:        vps.port(),
+		VPSUser:        "tunnel",
+		SSHPassword:    "hunter2",
+		KnownHostsPath: knownHosts,
+	})
+	s.logger.SetOutput(&syncBuffer{})
+
+	if got := s.knownHostKeyAlgorithms(addr); len(got) != 1 || got[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("host key algorithms = %v, want [%s]", got, ssh.KeyAlgoED25519)
+	}
+	client, err := s.dialSSH()
+	if err != nil {
+		t.Fatalf("dialSSH: %v", err)
+	}
+	client.Close()
+
+	// A different ed25519 key is still a changed key
+	s.config.TrustOnFirstUse = true
+	callback, err := s.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: vps.port()}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback(addr, remote, other); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("different ed25519 key: err = %v, want a changed host key", err)
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPub, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback(addr, remote, ecdsaPub); err != nil {
+		t.Fatalf("ECDSA key with only ed25519 recorded: %v", err)
+	}
+	data, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), ecdsaPub.Type()) {
+		t.Errorf("ECDSA key was not recorded:\n%s", data)
+	}
+}
+
+// TestEstablishTunnelFallback checks that a Go SSH tunnel which fails after
+// binding one of its forwards releases it before system ssh is started, and
+// that only one of the two tunnels ends up running
+func TestEstablishTunnelFallback(t *testing.T) {
+	bash, err := os.Stat("/bin/bash")
+	if err != nil || bash.IsDir() {
+		t.Skip("needs /bin/bash for the ssh stand-in")
+	}
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	tests := []struct {
+		name         string
+		refuseSecond bool
+		wantMode     tunnelMode
+		wantForwards int
+	}{
+		{name: "second forward refused", refuseSecond: true, wantMode: tunnelSystemSSH, wantForwards: 0},
+		{name: "all forwards bound", wantMode: tunnelGoSSH, wantForwards: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpPort, rtspPort := freePort(t), freePort(t)
+			var refuse []int
+			if tt.refuseSecond {
+				refuse = append(refuse, rtspPort)
+			}
+			vps := newFakeVPS(t, "hunter2", refuse...)
+
+			// The ssh stand-in records whether the Go tunnel's HTTP port
+			// was still bound when it was started, then runs until Stop
+			dir := t.TempDir()
+			marker := filepath.Join(dir, "fallback")
+			script := fmt.Sprintf("#!/bin/bash\nif (exec 3<>/dev/tcp/127.0.0.1/%d) 2>/dev/null; then echo bound > %s; else echo free > %s; fi\nexec sleep 30\n", httpPort, marker, marker)
+			sshPath := filepath.Join(dir, "ssh")
+			if err := os.WriteFile(sshPath, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			s := NewServer(&Config{
+				VPSHost:                  "127.0.0.1",
+				VPSPort:                  vps.port(),
+				VPSUser:                  "tunnel",
+				VPSHTTPPort:              httpPort,
+				SSHPassword:              "hunter2",
+				InsecureSkipHostKeyCheck: true,
+				KnownHostsPath:           filepath.Join(dir, "known_hosts"),
+				SSHBinaryPath:            sshPath,
+				ReadinessTimeout:         Duration(500 * time.Millisecond),
+				Forwards: []ForwardConfig{
+					{Name: "http", RemotePort: httpPort, LocalAddr: "127.0.0.1:1"},
+					{Name: "rtsp", RemotePort: rtspPort, LocalAddr: "127.0.0.1:1"},
+				},
+			})
+			s.logger.SetOutput(&syncBuffer{})
+			defer s.Stop()
+
+			if err := s.establishTunnel(); err != nil {
+				t.Fatalf("establishTunnel: %v", err)
+			}
+			if s.currentTunnelMode() != tt.wantMode {
+				t.Errorf("tunnel mode = %v, want %v", s.currentTunnelMode(), tt.wantMode)
+			}
+
+			if tt.wantMode == tunnelSystemSSH {
+				if s.currentTunnel() != nil {
+					t.Error("the failed Go tunnel is still current")
+				}
+				waitFor(t, func() bool {
+					_, err := os.Stat(marker)
+					return err == nil
+				})
+				data, _ := os.ReadFile(marker)
+				if got := strings.TrimSpace(string(data)); got != "free" {
+					t.Errorf("the Go tunnel's port was %s when system ssh started", got)
+				}
+				waitFor(t, func() bool {
+					_, connected := vps.state()
+					return connected == 0
+				})
+			} else {
+				if s.currentTunnel() == nil {
+					t.Error("no current Go tunnel")
+				}
+				if _, err := os.Stat(marker); err == nil {
+					t.Error("system ssh was started alongside the Go tunnel")
+				}
+				if err := s.createSystemSSHTunnel(); err == nil {
+					t.Error("createSystemSSHTunnel started a second tunnel")
+				}
+			}
+
+			if forwards, _ := vps.state(); forwards != tt.wantForwards {
+				t.Errorf("VPS has %d forwards bound, want %d", forwards, tt.wantForwards)
+			}
+		})
+	}
+}
+
+// TestReconnectDoesNotLeakGoroutines reconnects the Go SSH tunnel to a
+// loopback VPS several times and checks the goroutine count comes back to
+// where it was after the first connect
+func TestReconnectDoesNotLeakGoroutines(t *testing.T) {
+	const cycles = 10
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	vps := newFakeVPS(t, "hunter2")
+	dir := t.TempDir()
+	s := NewServer(&Config{
+		VPSHost:                  "127.0.0.1",
+		VPSPort:                  vps.port(),
+		VPSUser:                  "tunnel",
+		VPSHTTPPort:              freePort(t),
+		SSHPassword:              "hunter2",
+		InsecureSkipHostKeyCheck: true,
+		KnownHostsPath:           filepath.Join(dir, "known_hosts"),
+		LocalTargetAddr:          "127.0.0.1:1",
+	})
+	s.logger.SetOutput(&syncBuffer{})
+	defer s.Stop()
+
+	if err := s.createSSHTunnel(); err != nil {
+		t.Fatalf("createSSHTunnel: %v", err)
+	}
+	// Counted once the first tunnel is up, so its accept loops and the SSH
+	// client's goroutines are in the baseline
+	settle := func() int {
+		time.Sleep(50 * time.Millisecond)
+		return runtime.NumGoroutine()
+	}
+	before := settle()
+
+	for i := 0; i < cycles; i++ {
+		if err := s.reconnectSSH(); err != nil {
+			t.Fatalf("reconnect %d: %v", i+1, err)
+		}
+	}
+
+	// Goroutines of closed connections wind down asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	after := settle()
+	for after > before && time.Now().Before(deadline) {
+		after = settle()
+	}
+	if after > before {
+		t.Errorf("%d goroutines after %d reconnects, %d before", after, cycles, before)
+	}
+	if forwards, connected := vps.state(); forwards != 1 || connected != 1 {
+		t.Errorf("VPS has %d forwards and %d connections, want 1 of each", forwards, connected)
+	}
+}
+
+// TestHealthzDuringTunnelStart polls /healthz while the tunnel is being
+// established, as a monitoring probe may once the HTTP server is up; run
+// with -race
+func TestHealthzDuringTunnelStart(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	vps := newFakeVPS(t, "hunter2")
+	dir := t.TempDir()
+	s := NewServer(&Config{
+		VPSHost:                  "127.0.0.1",
+		VPSPort:                  vps.port(),
+		VPSUser:                  "tunnel",
+		VPSHTTPPort:              freePort(t),
+		SSHPassword:              "hunter2",
+		InsecureSkipHostKeyCheck: true,
+		KnownHostsPath:           filepath.Join(dir, "known_hosts"),
+		LocalTargetAddr:          "127.0.0.1:1",
+	})
+	s.logger.SetOutput(&syncBuffer{})
+	defer s.Stop()
+
+	healthz := func() map[string]interface{} {
+		rec := httptest.NewRecorder()
+		s.handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var status map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Errorf("invalid /healthz response: %v", err)
+		}
+		return status
+	}
+
+	done := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				healthz()
+			}
+		}
+	}()
+	err := s.establishTunnel()
+	close(done)
+	<-polled
+	if err != nil {
+		t.Fatalf("establishTunnel: %v", err)
+	}
+
+	if method := healthz()["tunnel_method"]; method != "go-ssh" {
+		t.Errorf("tunnel_method = %v once established, want go-ssh", method)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Validate checks the fields the service can't run without, reporting every
+// problem at once rather than stopping at the first
+func (c *Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.VPSHost == "" {
+		addf("vps_host is required")
+	}
+	if c.VPSUser == "" {
+		addf("vps_user is required")
+	}
+	if !c.hasSSHKey() && c.SSHPassword == "" && !c.SSHPasswordPrompt {
+		addf("one of ssh_key_path, ssh_key_pem, ssh_key_env, ssh_password or ssh_password_prompt is required")
+	}
+	if c.JumpHost != nil && c.JumpHost.Host == "" {
+		addf("jump_host.host is required when jump_host is set")
+	}
+	for _, port := range []struct {
+		name  string
+		value int
+	}{
+		{"vps_port", c.VPSPort},
+		{"local_http_port", c.LocalHTTPPort},
+		{"vps_http_port", c.VPSHTTPPort},
+	} {
+		if port.value < 1 || port.value > 65535 {
+			addf("%s must be between 1 and 65535, got %d", port.name, port.value)
+		}
+	}
+	// With the VPS on this machine, both ports would be bound on the same host
+	if c.LocalHTTPPort == c.VPSHTTPPort && isLoopbackHost(c.VPSHost) {
+		addf("local_http_port and vps_http_port are both %d on %s", c.LocalHTTPPort, c.VPSHost)
+	}
+
+	if c.LocalBindAddr != "" && !isLoopbackHost(c.LocalBindAddr) {
+		addf("local_bind_addr must be a loopback host such as 127.0.0.1, ::1 or localhost, got %q", c.LocalBindAddr)
+	}
+	if c.LocalBindHost != "" && c.LocalBindHost != "localhost" && net.ParseIP(c.LocalBindHost) == nil {
+		addf("local_bind_host must be an IP address such as 127.0.0.1, 192.168.1.10 or 0.0.0.0, got %q", c.LocalBindHost)
+	}
+
+	if err := c.validateLogFormat(); err != nil {
+		addf("%v", err)
+	}
+	if err := c.validateHWAccel(); err != nil {
+		addf("%v", err)
+	}
+	if err := c.validateQualityProfiles(); err != nil {
+		addf("%v", err)
+	}
+	if err := c.validateICEServers(); err != nil {
+		addf("%v", err)
+	}
+	if err := c.validateForwards(); err != nil {
+		addf("%v", err)
+	}
+	if err := c.validateRateLimit(); err != nil {
+		addf("%v", err)
+	}
+
+	if len(c.Cameras) == 0 {
+		addf("at least one camera must be configured")
+	}
+	ids := make([]string, 0, len(c.Cameras))
+	for id := range c.Cameras {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	authUsers := c.authUsers()
+	for _, id := range ids {
+		for _, err := range validateCamera(id, c.Cameras[id], authUsers) {
+			addf("camera %s: %v", id, err)
+		}
+	}
+
+	if _, err := buildSlugIndex(c.Cameras); err != nil {
+		addf("%v", err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s):\n  - %s", len(problems), strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// validateCamera checks one camera's settings, for both the config file and
+// the camera API, so a camera the API accepts never stops the next startup.
+// authUsers are the users allowed_users may name.
+func validateCamera(id string, camera Camera, authUsers map[string]string) []error {
+	var problems []error
+	if id == "status" {
+		problems = append(problems, fmt.Errorf("id is reserved for /api/cameras/status"))
+	}
+	if camera.RTSPURL == "" {
+		return append(problems, fmt.Errorf("rtsp_url is required"))
+	}
+	for _, rtspURL := range camera.rtspURLs() {
+		if err := validateRTSPURL(rtspURL); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	for _, check := range []func() error{camera.validateEncoding, camera.validateTransport, camera.validateFilters} {
+		if err := check(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	for _, user := range camera.AllowedUsers {
+		if _, known := authUsers[user]; !known {
+			problems = append(problems, fmt.Errorf("allowed_users: %q is not auth_username or in auth_users", user))
+		}
+	}
+	if camera.Record != nil {
+		if err := camera.Record.validate(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// validateRTSPURL checks that rtspURL is an rtsp:// or rtsps:// URL with a
+// host and a usable port
+func validateRTSPURL(rtspURL string) error {
+	if _, _, err := parseRTSPEndpoint(rtspURL); err != nil {
+		return fmt.Errorf("%v; expected rtsp://host:port/path", err)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
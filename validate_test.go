@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validTestConfig returns a config that passes Validate, with one camera
+func validTestConfig() *Config {
+	return &Config{
+		VPSHost:       "vps.example.com",
+		VPSPort:       22,
+		VPSUser:       "tunnel",
+		SSHPassword:   "hunter2",
+		LocalHTTPPort: 8080,
+		VPSHTTPPort:   8081,
+		Cameras: map[string]Camera{
+			"front": {Name: "Front", RTSPURL: "rtsp://127.0.0.1:554/front"},
+		},
+	}
+}
+
+func TestValidateCameras(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(c *Config)
+		wantErr string
+	}{
+		{name: "valid", edit: func(c *Config) {}},
+		{
+			name: "filter with labels",
+			edit: func(c *Config) {
+				camera := c.Cameras["front"]
+				camera.VideoFilters = "[0:v]scale=640:-2[out]"
+				c.Cameras["front"] = camera
+			},
+			wantErr: "camera front: video_filters must be a single filter chain",
+		},
+		{
+			name: "slug shadows a camera ID",
+			edit: func(c *Config) {
+				camera := c.Cameras["front"]
+				camera.Slug = "back"
+				c.Cameras["front"] = camera
+				c.Cameras["back"] = Camera{Name: "Back", RTSPURL: "rtsp://127.0.0.1:554/back"}
+			},
+			wantErr: `camera front: slug "back" collides with another camera's ID`,
+		},
+		{
+			name: "invalid slug",
+			edit: func(c *Config) {
+				camera := c.Cameras["front"]
+				camera.Slug = "Front Door"
+				c.Cameras["front"] = camera
+			},
+			wantErr: `slug "Front Door" must be lowercase`,
+		},
+		{
+			name: "unknown allowed user",
+			edit: func(c *Config) {
+				camera := c.Cameras["front"]
+				camera.AllowedUsers = []string{"mallory"}
+				c.Cameras["front"] = camera
+			},
+			wantErr: `camera front: allowed_users: "mallory" is not auth_username or in auth_users`,
+		},
+		{
+			name: "bad recording schedule",
+			edit: func(c *Config) {
+				camera := c.Cameras["front"]
+				camera.Record = &RecordConfig{Enabled: true, Start: "08:00"}
+				c.Cameras["front"] = camera
+			},
+			wantErr: "camera front: record: start and end must be set together",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validTestConfig()
+			tt.edit(config)
+			err := config.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	defaultSTUNServer = "stun:stun.l.google.com:19302"
+	// rtpPacketSize keeps FFmpeg's RTP packets under a typical path MTU once
+	// SRTP overhead is added
+	rtpPacketSize = 1200
+	// webrtcGatherTimeout bounds how long an answer waits for ICE candidates
+	webrtcGatherTimeout = 10 * time.Second
+	maxSDPOffer         = 64 * 1024
+)
+
+// ICEServer is a STUN or TURN server handed to WebRTC peers
+type ICEServer struct {
+	URLs       []string `json:"urls"`                 // e.g. ["stun:stun.example.com:3478"]
+	Username   string   `json:"username,omitempty"`   // TURN only
+	Credential string   `json:"credential,omitempty"` // TURN only
+}
+
+// iceServers returns the configured ICE servers, or Google's public STUN server
+func (c *Config) iceServers() []webrtc.ICEServer {
+	if len(c.ICEServers) == 0 {
+		return []webrtc.ICEServer{{URLs: []string{defaultSTUNServer}}}
+	}
+	servers := make([]webrtc.ICEServer, 0, len(c.ICEServers))
+	for _, server := range c.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers
+}
+
+// validateICEServers checks the ICE server URLs and that TURN servers have credentials
+func (c *Config) validateICEServers() error {
+	for i, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("ice_servers[%d]: urls is required", i)
+		}
+		for _, u := range server.URLs {
+			scheme, _, _ := strings.Cut(u, ":")
+			switch scheme {
+			case "stun", "stuns":
+			case "turn", "turns":
+				if server.Username == "" || server.Credential == "" {
+					return fmt.Errorf("ice_servers[%d]: %s needs username and credential", i, u)
+				}
+			default:
+				return fmt.Errorf("ice_servers[%d]: %q must start with stun:, stuns:, turn: or turns:", i, u)
+			}
+		}
+	}
+	return nil
+}
+
+// buildWebRTCArgs returns FFmpeg args that transcode rtspURL into H.264 RTP
+// on videoPort and, if audioPort is set, Opus RTP on audioPort. Browsers
+// can't decode B-frames over WebRTC, and the parameter sets are repeated
+// before every keyframe so peers can join mid-stream.
+func buildWebRTCArgs(camera Camera, rtspURL string, hw hwAccel, videoPort, audioPort int) []string {
+	args := transcodeInputArgs(camera, rtspURL, hw)
+	args = append(args, "-map", "0:v:0")
+	if chain := camera.withVideoFilters(hw.UploadFilter); chain != "" {
+		args = append(args, "-vf", chain)
+	}
+	args = append(args, camera.videoArgs(hw)...)
+	if hw.Encoder == softwareEncoding.Encoder {
+		// Matches the profile-level-id offered for the video track
+		args = append(args, "-profile:v", "baseline")
+	}
+	args = append(args,
+		"-bf", "0",
+		"-bsf:v", "dump_extra",
+		"-f", "rtp",
+		fmt.Sprintf("rtp://127.0.0.1:%d?pkt_size=%d", videoPort, rtpPacketSize),
+	)
+
+	if audioPort > 0 {
+		args = append(args, "-map", "0:a:0")
+		if camera.AudioFilters != "" {
+			args = append(args, "-af", camera.AudioFilters)
+		}
+		args = append(args,
+			"-c:a", "libopus",
+			"-ar", "48000",
+			"-ac", "2",
+			"-b:a", "64k",
+			"-f", "rtp",
+			fmt.Sprintf("rtp://127.0.0.1:%d?pkt_size=%d", audioPort, rtpPacketSize),
+		)
+	}
+	return args
+}
+
+// webrtcSource is one FFmpeg transcode whose RTP output feeds tracks shared
+// by every WebRTC peer watching a camera
+type webrtcSource struct {
+	cameraID string
+	video    *webrtc.TrackLocalStaticRTP
+	audio    *webrtc.TrackLocalStaticRTP // nil unless the camera has webrtc_audio
+	cmd      *exec.Cmd
+
+	mu        sync.Mutex
+	peers     map[*webrtc.PeerConnection]struct{}
+	idleTimer *time.Timer
+	stopped   bool
+}
+
+// webrtcSources holds the running source per camera
+type webrtcSources struct {
+	mu      sync.Mutex
+	sources map[string]*webrtcSource
+}
+
+// addPeer attaches pc to the source, or reports false if it has stopped
+func (src *webrtcSource) addPeer(pc *webrtc.PeerConnection) bool {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.stopped {
+		return false
+	}
+	if src.idleTimer != nil {
+		src.idleTimer.Stop()
+		src.idleTimer = nil
+	}
+	src.peers[pc] = struct{}{}
+	return true
+}
+
+// removeWebRTCPeer detaches pc, stopping FFmpeg after the grace period if it was the last
+func (s *Server) removeWebRTCPeer(src *webrtcSource, pc *webrtc.PeerConnection) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if _, ok := src.peers[pc]; !ok {
+		return
+	}
+	delete(src.peers, pc)
+
+	if len(src.peers) == 0 && !src.stopped {
+		src.idleTimer = time.AfterFunc(s.config.streamGracePeriod(), func() {
+			src.mu.Lock()
+			idle := len(src.peers) == 0 && !src.stopped
+			if idle {
+				src.stopped = true
+			}
+			src.mu.Unlock()
+			if idle {
+				s.logger.Printf("No WebRTC peers left for %s, stopping transcode", src.cameraID)
+				stopFFmpeg(src.cmd)
+			}
+		})
+	}
+}
+
+// joinWebRTC attaches pc to cameraID's source, starting one if none is running
+func (s *Server) joinWebRTC(cameraID string, camera Camera, pc *webrtc.PeerConnection) (*webrtcSource, error) {
+	s.webrtcSources.mu.Lock()
+	// A source stopped for being idle may not have exited yet
+	src, ok := s.webrtcSources.sources[cameraID]
+	joined := ok && src.addPeer(pc)
+	s.webrtcSources.mu.Unlock()
+	if joined {
+		return src, nil
+	}
+
+	// Picking the RTSP URL may probe unreachable failover URLs, so it runs
+	// without the lock every WebRTC viewer needs
+	rtspURL := s.selectRTSPURL(camera)
+
+	s.webrtcSources.mu.Lock()
+	defer s.webrtcSources.mu.Unlock()
+	// Another viewer may have started it in the meantime
+	if src, ok := s.webrtcSources.sources[cameraID]; ok && src.addPeer(pc) {
+		return src, nil
+	}
+
+	src, err := s.startWebRTCSource(cameraID, camera, rtspURL)
+	if err != nil {
+		return nil, err
+	}
+	if s.webrtcSources.sources == nil {
+		s.webrtcSources.sources = make(map[string]*webrtcSource)
+	}
+	s.webrtcSources.sources[cameraID] = src
+	src.addPeer(pc)
+	return src, nil
+}
+
+// listenRTP opens a loopback UDP socket for FFmpeg to send RTP to
+func listenRTP() (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RTP socket: %v", err)
+	}
+	return conn, nil
+}
+
+// startWebRTCSource starts FFmpeg reading rtspURL for the camera and the
+// goroutines that forward its RTP packets into the shared tracks
+func (s *Server) startWebRTCSource(cameraID string, camera Camera, rtspURL string) (*webrtcSource, error) {
+	camera = s.withCameraDefaults(camera)
+
+	video, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", cameraID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create video track: %v", err)
+	}
+	videoConn, err := listenRTP()
+	if err != nil {
+		return nil, err
+	}
+	conns := []*net.UDPConn{videoConn}
+	tracks := []*webrtc.TrackLocalStaticRTP{video}
+	closeConns := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	src := &webrtcSource{
+		cameraID: cameraID,
+		video:    video,
+		peers:    make(map[*webrtc.PeerConnection]struct{}),
+	}
+
+	audioPort := 0
+	if camera.WebRTCAudio && !camera.audioDisabled() {
+		audio, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: 48000,
+			Channels:  2,
+		}, "audio", cameraID)
+		if err != nil {
+			closeConns()
+			return nil, fmt.Errorf("failed to create audio track: %v", err)
+		}
+		audioConn, err := listenRTP()
+		if err != nil {
+			closeConns()
+			return nil, err
+		}
+		conns = append(conns, audioConn)
+		tracks = append(tracks, audio)
+		src.audio = audio
+		audioPort = audioConn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	videoPort := videoConn.LocalAddr().(*net.UDPAddr).Port
+	cmd := s.ffmpegCommand(s.ctx, buildWebRTCArgs(camera, rtspURL, s.hwAccel, videoPort, audioPort)...)
+	cmd.Stderr = &streamInfoWriter{store: &s.streamInfo, cameraID: cameraID}
+	if err := s.startFFmpeg(cmd); err != nil {
+		closeConns()
+		s.metrics.ffmpegFailed(cameraID, "webrtc")
+		return nil, fmt.Errorf("failed to start FFmpeg: %v", err)
+	}
+	src.cmd = cmd
+	s.metrics.ffmpegStarted(cameraID, "webrtc")
+	s.logger.Printf("Started WebRTC transcode for %s (%s)", camera.Name, cameraID)
+
+	for i := range conns {
+		s.wg.Add(1)
+		go func(conn *net.UDPConn, track *webrtc.TrackLocalStaticRTP) {
+			defer s.wg.Done()
+			forwardRTP(conn, track)
+		}(conns[i], tracks[i])
+	}
+
+	unregister := s.work.add(fmt.Sprintf("%s WebRTC transcode", cameraID), closerFunc(func() error {
+		return cmd.Process.Kill()
+	}))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer unregister()
+
+		err := cmd.Wait()
+		closeConns()
+
+		src.mu.Lock()
+		idleStop := src.stopped
+		src.stopped = true
+		peers := make([]*webrtc.PeerConnection, 0, len(src.peers))
+		for pc := range src.peers {
+			peers = append(peers, pc)
+		}
+		src.mu.Unlock()
+
+		if s.ctx.Err() == nil && !idleStop {
+			s.logger.Printf("WebRTC transcode for %s exited: %v", camera.Name, err)
+			s.metrics.ffmpegFailed(cameraID, "webrtc")
+		}
+
+		s.webrtcSources.mu.Lock()
+		if s.webrtcSources.sources[cameraID] == src {
+			delete(s.webrtcSources.sources, cameraID)
+		}
+		s.webrtcSources.mu.Unlock()
+
+		// Closing the peers tells their browsers to reconnect, which starts a new transcode
+		for _, pc := range peers {
+			pc.Close()
+		}
+	}()
+
+	return src, nil
+}
+
+// forwardRTP copies FFmpeg's RTP packets into track until conn is closed.
+// The track rewrites SSRC and payload type for each peer.
+func forwardRTP(conn *net.UDPConn, track *webrtc.TrackLocalStaticRTP) {
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		track.Write(buf[:n])
+	}
+}
+
+// handleWebRTC answers a WebRTC offer for /webrtc/{id}. The browser POSTs
+// its offer as {"type": "offer", "sdp": "..."} and gets the answer back in
+// the same form once ICE candidates are gathered, so no trickle ICE
+// signaling is needed.
+func (s *Server) handleWebRTC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cameraID := strings.TrimPrefix(r.URL.Path, "/webrtc/")
+
+	camera, exists := s.camera(cameraID)
+	if !exists {
+		writeJSONError(w, fmt.Sprintf("Camera '%s' not found", cameraID), http.StatusNotFound)
+		return
+	}
+	if !cameraVisible(r, camera) {
+		writeJSONError(w, fmt.Sprintf("Camera '%s' is only available on the local network", cameraID), http.StatusForbidden)
+		return
+	}
+	if !s.cameraAllowed(r, camera) {
+		writeJSONError(w, fmt.Sprintf("You are not allowed to view camera '%s'", cameraID), http.StatusForbidden)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSDPOffer)).Decode(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+		writeJSONError(w, `Expected a JSON SDP offer: {"type": "offer", "sdp": "..."}`, http.StatusBadRequest)
+		return
+	}
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: s.config.iceServers()})
+	if err != nil {
+		s.logger.Printf("Failed to create WebRTC peer for %s: %v", camera.Name, err)
+		writeJSONError(w, "Failed to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	src, err := s.joinWebRTC(cameraID, camera, pc)
+	if err != nil {
+		pc.Close()
+		s.logger.Printf("Failed to start WebRTC for %s: %v", camera.Name, err)
+		writeJSONError(w, "Failed to start stream", http.StatusInternalServerError)
+		return
+	}
+
+	s.activeStreams.Add(1)
+	var once sync.Once
+	leave := func() {
+		once.Do(func() {
+			pc.Close()
+			s.removeWebRTCPeer(src, pc)
+			s.activeStreams.Add(-1)
+			s.markActivity()
+		})
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			s.logger.Printf("WebRTC peer connected to %s", camera.Name)
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.logger.Printf("WebRTC peer for %s %s", camera.Name, state)
+			go leave()
+		}
+	})
+
+	answer, err := s.answerWebRTC(r, pc, src, offer)
+	if err != nil {
+		leave()
+		s.logger.Printf("WebRTC negotiation for %s failed: %v", camera.Name, err)
+		writeJSONError(w, fmt.Sprintf("WebRTC negotiation failed: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(answer)
+}
+
+// answerWebRTC adds the source's tracks to pc and returns the answer to
+// offer with the gathered ICE candidates included
+func (s *Server) answerWebRTC(r *http.Request, pc *webrtc.PeerConnection, src *webrtcSource, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	for _, track := range []*webrtc.TrackLocalStaticRTP{src.video, src.audio} {
+		if track == nil {
+			continue
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s track: %v", track.Kind(), err)
+		}
+		// RTCP has to be read for NACKs and receiver reports to be processed
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return nil, fmt.Errorf("invalid offer: %v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(webrtcGatherTimeout)
+	defer timeout.Stop()
+	select {
+	case <-gathered:
+	case <-timeout.C:
+		// Answer with the candidates found so far
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	return pc.LocalDescription(), nil
+}